@@ -1,9 +1,9 @@
 package casbinpgadapter
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-	"log"
+	"time"
 
 	casbinModel "github.com/casbin/casbin/v2/model"
 	"github.com/casbin/casbin/v2/persist"
@@ -11,6 +11,7 @@ import (
 	// no-lint
 	_ "github.com/lib/pq"
 
+	"github.com/cychiuae/casbin-pg-adapter/pkg/migration"
 	"github.com/cychiuae/casbin-pg-adapter/pkg/model"
 	"github.com/cychiuae/casbin-pg-adapter/pkg/repository"
 )
@@ -21,103 +22,154 @@ type Adapter struct {
 	dbSchema             string
 	tableName            string
 	casbinRuleRepository *repository.CasbinRuleRepository
+	options              options
 }
 
-// NewAdapter returns a new casbin postgresql adapter
-func NewAdapter(db *sql.DB, tableName string) (*Adapter, error) {
-	return NewAdapterWithDBSchema(db, "public", tableName)
+var (
+	_ persist.BatchAdapter     = (*Adapter)(nil)
+	_ persist.UpdatableAdapter = (*Adapter)(nil)
+	_ persist.ContextAdapter   = (*Adapter)(nil)
+)
+
+// New returns a new casbin postgresql adapter configured by opts
+func New(db *sql.DB, opts ...Option) (*Adapter, error) {
+	return NewCtx(context.Background(), db, opts...)
 }
 
-// NewAdapterWithDBSchema returns a new casbin postgresql adapter with the schema named dbSchema
-func NewAdapterWithDBSchema(db *sql.DB, dbSchema string, tableName string) (*Adapter, error) {
-	casbinRuleRepository := repository.NewCasbinRuleRepository(dbSchema, tableName, db)
-	adapter := &Adapter{
+// NewCtx is New with a context.Context
+func NewCtx(ctx context.Context, db *sql.DB, opts ...Option) (*Adapter, error) {
+	o, err := newOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	casbinRuleRepository := repository.NewCasbinRuleRepository(
+		o.dbSchema,
+		o.tableName,
 		db,
-		dbSchema,
-		tableName,
-		casbinRuleRepository,
+		repository.WithFieldCount(o.fieldCount),
+		repository.WithTenantColumn(o.tenantColumn),
+		repository.WithRowLevelSecurity(o.rowLevelSecuritySetting),
+		repository.WithAuditTable(o.auditTableName()),
+		repository.WithAuditKey(o.auditKey),
+		repository.WithTemporal(o.temporal),
+	)
+	adapter := &Adapter{
+		db:                   db,
+		dbSchema:             o.dbSchema,
+		tableName:            o.tableName,
+		casbinRuleRepository: casbinRuleRepository,
+		options:              o,
 	}
 
-	if err := adapter.setup(); err != nil {
+	if err := adapter.setup(ctx); err != nil {
 		return nil, err
 	}
 
 	return adapter, nil
 }
 
-func (adapter *Adapter) setup() error {
-	if err := adapter.createTableIfNeeded(); err != nil {
+// NewAdapter returns a new casbin postgresql adapter
+func NewAdapter(db *sql.DB, tableName string, opts ...Option) (*Adapter, error) {
+	return NewAdapterWithDBSchema(db, defaultDBSchema, tableName, opts...)
+}
+
+// NewAdapterCtx is NewAdapter with a context.Context
+func NewAdapterCtx(ctx context.Context, db *sql.DB, tableName string, opts ...Option) (*Adapter, error) {
+	return NewAdapterWithDBSchemaCtx(ctx, db, defaultDBSchema, tableName, opts...)
+}
+
+// NewAdapterWithDBSchema returns a new casbin postgresql adapter with the schema named dbSchema
+func NewAdapterWithDBSchema(db *sql.DB, dbSchema string, tableName string, opts ...Option) (*Adapter, error) {
+	return NewAdapterWithDBSchemaCtx(context.Background(), db, dbSchema, tableName, opts...)
+}
+
+// NewAdapterWithDBSchemaCtx is NewAdapterWithDBSchema with a context.Context
+func NewAdapterWithDBSchemaCtx(ctx context.Context, db *sql.DB, dbSchema string, tableName string, opts ...Option) (*Adapter, error) {
+	return NewCtx(ctx, db, append([]Option{WithDBSchema(dbSchema), WithTableName(tableName)}, opts...)...)
+}
+
+func (adapter *Adapter) setup(ctx context.Context) error {
+	if !adapter.options.autoMigrate {
+		return migration.Verify(ctx, adapter.db, adapter.migrationTable())
+	}
+	if err := adapter.MigrateCtx(ctx); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (adapter *Adapter) createTableIfNeeded() error {
-	tx, err := adapter.db.Begin()
+// ForTenant returns a view of adapter whose operations only apply to the rules
+// of tenantID. It requires WithTenantColumn.
+func (adapter *Adapter) ForTenant(tenantID string) (*Adapter, error) {
+	casbinRuleRepository, err := adapter.casbinRuleRepository.ForTenant(tenantID)
 	if err != nil {
-		log.Print("Cannot start transaction")
-		return err
-	}
-	_, err = tx.Exec(fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS "%s"."%s" (
-			p_type varchar(256) not null default '',
-			v0 		varchar(256) not null default '',
-			v1 		varchar(256) not null default '',
-			v2 		varchar(256) not null default '',
-			v3 		varchar(256) not null default '',
-			v4 		varchar(256) not null default '',
-			v5 		varchar(256) not null default ''
-		)
-	`, adapter.dbSchema, adapter.tableName))
-	if err != nil {
-		_ = tx.Rollback()
-		log.Printf("Cannot create table %v", err)
-		return err
-	}
-	columns := [7]string{
-		"p_type",
-		"v0",
-		"v1",
-		"v2",
-		"v3",
-		"v4",
-		"v5",
-	}
-	for _, column := range columns {
-		_, err = tx.Exec(fmt.Sprintf(`
-			CREATE INDEX IF NOT EXISTS idx_%[2]s_%[3]s ON "%[1]s"."%[2]s" (%[3]s)
-		`, adapter.dbSchema, adapter.tableName, column))
-		if err != nil {
-			log.Printf("Cannot create index for column: %v. Error: %v", column, err)
-			_ = tx.Rollback()
-			return err
-		}
+		return nil, err
 	}
-	err = tx.Commit()
-	if err != nil {
-		log.Printf("Cannot commit transaction %v", err)
-		_ = tx.Rollback()
-		return err
+	tenantAdapter := *adapter
+	tenantAdapter.casbinRuleRepository = casbinRuleRepository
+	return &tenantAdapter, nil
+}
+
+// Migrate applies the pending schema migrations to the casbin table, creating it
+// if needed. It is safe to call from several instances at once.
+func (adapter *Adapter) Migrate() error {
+	return adapter.MigrateCtx(context.Background())
+}
+
+// MigrateCtx is Migrate with a context.Context
+func (adapter *Adapter) MigrateCtx(ctx context.Context) error {
+	return migration.Migrate(ctx, adapter.db, adapter.migrationTable(), migration.Migrations, adapter.options.logger)
+}
+
+func (adapter *Adapter) migrationTable() migration.Table {
+	return migration.Table{
+		Schema:                  adapter.dbSchema,
+		Name:                    adapter.tableName,
+		ColumnWidth:             adapter.options.columnWidth,
+		FieldCount:              adapter.options.fieldCount,
+		Indexes:                 adapter.options.indexes,
+		TenantColumn:            adapter.options.tenantColumn,
+		RowLevelSecuritySetting: adapter.options.rowLevelSecuritySetting,
+		AuditTable:              adapter.options.auditTableName(),
+		Temporal:                adapter.options.temporal,
 	}
-	return nil
 }
 
 // LoadPolicy loads all policy rules from the storage.
 func (adapter *Adapter) LoadPolicy(cmodel casbinModel.Model) error {
-	casbinRules, err := adapter.casbinRuleRepository.LoadAllCasbinRules()
+	return adapter.LoadPolicyCtx(context.Background(), cmodel)
+}
+
+// LoadPolicyCtx is LoadPolicy with a context.Context
+func (adapter *Adapter) LoadPolicyCtx(ctx context.Context, cmodel casbinModel.Model) error {
+	casbinRules, err := adapter.casbinRuleRepository.LoadAllCasbinRulesCtx(ctx)
 	if err != nil {
 		return err
 	}
 
-	for _, casbinRule := range casbinRules {
-		persist.LoadPolicyLine(casbinRule.ToPolicyLine(), cmodel)
-	}
+	return loadCasbinRules(cmodel, casbinRules)
+}
 
-	return nil
+// LoadPolicyAsOf replaces the policy of cmodel with the policy stored at the
+// instant asOf. Unlike LoadPolicy, it clears cmodel first, since it is not
+// called by the enforcer; rebuild the role links of the enforcer after it. It
+// requires WithTemporal.
+func (adapter *Adapter) LoadPolicyAsOf(cmodel casbinModel.Model, asOf time.Time) error {
+	return adapter.LoadPolicyAsOfCtx(context.Background(), cmodel, asOf)
 }
 
-// SavePolicy saves all policy rules to the storage.
-func (adapter *Adapter) SavePolicy(cmodel casbinModel.Model) error {
+// LoadPolicyAsOfCtx is LoadPolicyAsOf with a context.Context
+func (adapter *Adapter) LoadPolicyAsOfCtx(ctx context.Context, cmodel casbinModel.Model, asOf time.Time) error {
+	casbinRules, err := adapter.casbinRuleRepository.LoadCasbinRulesAsOfCtx(ctx, asOf)
+	if err != nil {
+		return err
+	}
+	cmodel.ClearPolicy()
+	return loadCasbinRules(cmodel, casbinRules)
+}
+
+// casbinRulesFromModel returns the casbin rules of the policy of cmodel
+func casbinRulesFromModel(cmodel casbinModel.Model) []model.CasbinRule {
 	casbinRules := make([]model.CasbinRule, 0)
 	for pType, ast := range cmodel["p"] {
 		for _, rule := range ast.Policy {
@@ -131,32 +183,167 @@ func (adapter *Adapter) SavePolicy(cmodel casbinModel.Model) error {
 			casbinRules = append(casbinRules, casbinRule)
 		}
 	}
-	if err := adapter.casbinRuleRepository.ReplaceAllCasbinRules(casbinRules); err != nil {
-		return err
+	return casbinRules
+}
+
+// loadCasbinRules adds casbinRules to cmodel, skipping those it already has.
+// The fields are handed over as they are stored, since joining them into a
+// policy line to parse it again would split values holding a comma or a quote.
+func loadCasbinRules(cmodel casbinModel.Model, casbinRules []model.CasbinRule) error {
+	for _, casbinRule := range casbinRules {
+		if err := persist.LoadPolicyArray(casbinRule.ToStringSlice(), cmodel); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// SavePolicy saves all policy rules to the storage.
+func (adapter *Adapter) SavePolicy(cmodel casbinModel.Model) error {
+	return adapter.SavePolicyCtx(context.Background(), cmodel)
+}
+
+// SavePolicyCtx is SavePolicy with a context.Context
+func (adapter *Adapter) SavePolicyCtx(ctx context.Context, cmodel casbinModel.Model) error {
+	casbinRules := casbinRulesFromModel(cmodel)
+	switch adapter.options.savePolicyMode {
+	case SavePolicyModeTruncate:
+		return adapter.casbinRuleRepository.ReplaceAllCasbinRulesCtx(ctx, casbinRules)
+	case SavePolicyModeCopy:
+		return adapter.casbinRuleRepository.CopyAllCasbinRulesCtx(ctx, casbinRules, adapter.options.copyBatchSize)
+	default:
+		return adapter.casbinRuleRepository.SyncAllCasbinRulesCtx(ctx, casbinRules)
+	}
+}
+
 // AddPolicy adds a policy rule to the storage.
 // This is part of the Auto-Save feature.
 func (adapter *Adapter) AddPolicy(sec string, ptype string, rule []string) error {
+	return adapter.AddPolicyCtx(context.Background(), sec, ptype, rule)
+}
+
+// AddPolicyCtx is AddPolicy with a context.Context
+func (adapter *Adapter) AddPolicyCtx(ctx context.Context, sec string, ptype string, rule []string) error {
 	casbinRule := model.NewCasbinRuleFromPTypeAndRule(ptype, rule)
-	err := adapter.casbinRuleRepository.InsertCasbinRule(casbinRule)
+	err := adapter.casbinRuleRepository.InsertCasbinRuleCtx(ctx, casbinRule)
 	return err
 }
 
 // RemovePolicy removes a policy rule from the storage.
 // This is part of the Auto-Save feature.
 func (adapter *Adapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	return adapter.RemovePolicyCtx(context.Background(), sec, ptype, rule)
+}
+
+// RemovePolicyCtx is RemovePolicy with a context.Context
+func (adapter *Adapter) RemovePolicyCtx(ctx context.Context, sec string, ptype string, rule []string) error {
 	casbinRule := model.NewCasbinRuleFromPTypeAndRule(ptype, rule)
-	err := adapter.casbinRuleRepository.DeleteCasbinRule(casbinRule)
+	err := adapter.casbinRuleRepository.DeleteCasbinRuleCtx(ctx, casbinRule)
 	return err
 }
 
 // RemoveFilteredPolicy removes policy rules that match the filter from the storage.
 // This is part of the Auto-Save feature.
 func (adapter *Adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	return adapter.RemoveFilteredPolicyCtx(context.Background(), sec, ptype, fieldIndex, fieldValues...)
+}
+
+// RemoveFilteredPolicyCtx is RemoveFilteredPolicy with a context.Context
+func (adapter *Adapter) RemoveFilteredPolicyCtx(ctx context.Context, sec string, ptype string, fieldIndex int, fieldValues ...string) error {
 	casbinRule := model.NewCasbinRuleFromPTypeAndFilter(ptype, fieldIndex, fieldValues...)
-	err := adapter.casbinRuleRepository.DeleteCasbinRule(casbinRule)
+	err := adapter.casbinRuleRepository.DeleteFilteredCasbinRuleCtx(ctx, casbinRule)
 	return err
 }
+
+// AddPolicies adds policy rules to the storage.
+// This is part of the Auto-Save feature.
+func (adapter *Adapter) AddPolicies(sec string, ptype string, rules [][]string) error {
+	return adapter.AddPoliciesCtx(context.Background(), sec, ptype, rules)
+}
+
+// AddPoliciesCtx is AddPolicies with a context.Context
+func (adapter *Adapter) AddPoliciesCtx(ctx context.Context, sec string, ptype string, rules [][]string) error {
+	casbinRules := make([]model.CasbinRule, 0, len(rules))
+	for _, rule := range rules {
+		casbinRules = append(casbinRules, model.NewCasbinRuleFromPTypeAndRule(ptype, rule))
+	}
+	err := adapter.casbinRuleRepository.InsertCasbinRulesCtx(ctx, casbinRules)
+	return err
+}
+
+// RemovePolicies removes policy rules from the storage.
+// This is part of the Auto-Save feature.
+func (adapter *Adapter) RemovePolicies(sec string, ptype string, rules [][]string) error {
+	return adapter.RemovePoliciesCtx(context.Background(), sec, ptype, rules)
+}
+
+// RemovePoliciesCtx is RemovePolicies with a context.Context
+func (adapter *Adapter) RemovePoliciesCtx(ctx context.Context, sec string, ptype string, rules [][]string) error {
+	casbinRules := make([]model.CasbinRule, 0, len(rules))
+	for _, rule := range rules {
+		casbinRules = append(casbinRules, model.NewCasbinRuleFromPTypeAndRule(ptype, rule))
+	}
+	err := adapter.casbinRuleRepository.DeleteCasbinRulesCtx(ctx, casbinRules)
+	return err
+}
+
+// UpdatePolicy updates a policy rule in the storage.
+// This is part of the Auto-Save feature.
+func (adapter *Adapter) UpdatePolicy(sec string, ptype string, oldRule, newRule []string) error {
+	return adapter.UpdatePolicyCtx(context.Background(), sec, ptype, oldRule, newRule)
+}
+
+// UpdatePolicyCtx is UpdatePolicy with a context.Context
+func (adapter *Adapter) UpdatePolicyCtx(ctx context.Context, sec string, ptype string, oldRule, newRule []string) error {
+	_, err := adapter.casbinRuleRepository.UpdateCasbinRuleCtx(
+		ctx,
+		model.NewCasbinRuleFromPTypeAndRule(ptype, oldRule),
+		model.NewCasbinRuleFromPTypeAndRule(ptype, newRule),
+	)
+	return err
+}
+
+// UpdatePolicies updates policy rules in the storage.
+// This is part of the Auto-Save feature.
+func (adapter *Adapter) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	return adapter.UpdatePoliciesCtx(context.Background(), sec, ptype, oldRules, newRules)
+}
+
+// UpdatePoliciesCtx is UpdatePolicies with a context.Context
+func (adapter *Adapter) UpdatePoliciesCtx(ctx context.Context, sec string, ptype string, oldRules, newRules [][]string) error {
+	oldCasbinRules := make([]model.CasbinRule, 0, len(oldRules))
+	for _, rule := range oldRules {
+		oldCasbinRules = append(oldCasbinRules, model.NewCasbinRuleFromPTypeAndRule(ptype, rule))
+	}
+	newCasbinRules := make([]model.CasbinRule, 0, len(newRules))
+	for _, rule := range newRules {
+		newCasbinRules = append(newCasbinRules, model.NewCasbinRuleFromPTypeAndRule(ptype, rule))
+	}
+	_, err := adapter.casbinRuleRepository.UpdateCasbinRulesCtx(ctx, oldCasbinRules, newCasbinRules)
+	return err
+}
+
+// UpdateFilteredPolicies replaces the policy rules that match the filter with
+// newRules in the storage and returns the rules replaced.
+// This is part of the Auto-Save feature.
+func (adapter *Adapter) UpdateFilteredPolicies(sec string, ptype string, newRules [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	return adapter.UpdateFilteredPoliciesCtx(context.Background(), sec, ptype, newRules, fieldIndex, fieldValues...)
+}
+
+// UpdateFilteredPoliciesCtx is UpdateFilteredPolicies with a context.Context
+func (adapter *Adapter) UpdateFilteredPoliciesCtx(ctx context.Context, sec string, ptype string, newRules [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	filter := model.NewCasbinRuleFromPTypeAndFilter(ptype, fieldIndex, fieldValues...)
+	newCasbinRules := make([]model.CasbinRule, 0, len(newRules))
+	for _, rule := range newRules {
+		newCasbinRules = append(newCasbinRules, model.NewCasbinRuleFromPTypeAndRule(ptype, rule))
+	}
+	oldCasbinRules, err := adapter.casbinRuleRepository.UpdateFilteredCasbinRulesCtx(ctx, filter, newCasbinRules)
+	if err != nil {
+		return nil, err
+	}
+	oldRules := make([][]string, 0, len(oldCasbinRules))
+	for _, casbinRule := range oldCasbinRules {
+		oldRules = append(oldRules, casbinRule.ToStringSlice()[1:])
+	}
+	return oldRules, nil
+}
@@ -1,15 +1,29 @@
 package casbinpgadapter
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/casbin/casbin/v2"
+	casbinmodel "github.com/casbin/casbin/v2/model"
 	"github.com/casbin/casbin/v2/util"
+	"github.com/cychiuae/casbin-pg-adapter/pkg/migration"
 	"github.com/cychiuae/casbin-pg-adapter/pkg/model"
 )
 
+// sortedPolicy returns a sorted copy of policy for order-insensitive comparison
+func sortedPolicy(policy [][]string) [][]string {
+	sorted := make([][]string, len(policy))
+	copy(sorted, policy)
+	util.SortArray2D(sorted)
+	return sorted
+}
+
 // TestAdapter is a very bad all-in-one integration test to test the adapter
 func TestAdapter(t *testing.T) {
 	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
@@ -174,3 +188,1557 @@ func TestFilteredAdapter(t *testing.T) {
 		return
 	}
 }
+
+func TestBatchAdapter(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", "./example/policy.csv")
+	if err != nil {
+		t.Fatal("Cannot create enforcer")
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin")
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	if err = adapter.SavePolicy(enforcer.GetModel()); err != nil {
+		t.Fatalf("Cannot initial policy %v", err)
+		return
+	}
+
+	enforcer, err = casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+
+	if _, err = enforcer.AddPolicies([][]string{{"alice", "data1", "write"}, {"bob", "data1", "read"}}); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy")
+		return
+	}
+	enforcerPolicy := enforcer.GetPolicy()
+	want := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"alice", "data1", "write"}, {"bob", "data1", "read"}}
+	if !util.Array2DEquals(enforcerPolicy, want) {
+		t.Fatalf("Want %v but got %v", want, enforcerPolicy)
+		return
+	}
+
+	if _, err = enforcer.RemovePolicies([][]string{{"alice", "data1", "write"}, {"bob", "data1", "read"}}); err != nil {
+		t.Fatalf("Cannot remove policies %v", err)
+		return
+	}
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy")
+		return
+	}
+	enforcerPolicy = enforcer.GetPolicy()
+	want = [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+	if !util.Array2DEquals(enforcerPolicy, want) {
+		t.Fatalf("Want %v but got %v", want, enforcerPolicy)
+		return
+	}
+
+	// A failing row must roll back the rows inserted before it.
+	tooLong := strings.Repeat("x", 300)
+	if err = adapter.AddPolicies("p", "p", [][]string{{"carol", "data1", "read"}, {tooLong, "data1", "read"}}); err == nil {
+		t.Fatalf("Want error when adding a rule longer than the column width")
+		return
+	}
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy")
+		return
+	}
+	enforcerPolicy = enforcer.GetPolicy()
+	if !util.Array2DEquals(enforcerPolicy, want) {
+		t.Fatalf("Want %v but got %v", want, enforcerPolicy)
+		return
+	}
+}
+
+func TestUpdatableAdapter(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", "./example/policy.csv")
+	if err != nil {
+		t.Fatal("Cannot create enforcer")
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin")
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	if err = adapter.SavePolicy(enforcer.GetModel()); err != nil {
+		t.Fatalf("Cannot initial policy %v", err)
+		return
+	}
+
+	enforcer, err = casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+
+	// Updated rows may come back in a different order, so compare sorted policies.
+	if _, err = enforcer.UpdatePolicy([]string{"alice", "data1", "read"}, []string{"alice", "data1", "write"}); err != nil {
+		t.Fatalf("Cannot update policy %v", err)
+		return
+	}
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy")
+		return
+	}
+	enforcerPolicy := enforcer.GetPolicy()
+	want := [][]string{{"alice", "data1", "write"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+	if !util.Array2DEquals(sortedPolicy(enforcerPolicy), sortedPolicy(want)) {
+		t.Fatalf("Want %v but got %v", want, enforcerPolicy)
+		return
+	}
+
+	if _, err = enforcer.UpdatePolicies(
+		[][]string{{"alice", "data1", "write"}, {"bob", "data2", "write"}},
+		[][]string{{"alice", "data1", "read"}, {"bob", "data2", "read"}},
+	); err != nil {
+		t.Fatalf("Cannot update policies %v", err)
+		return
+	}
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy")
+		return
+	}
+	enforcerPolicy = enforcer.GetPolicy()
+	want = [][]string{{"alice", "data1", "read"}, {"bob", "data2", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+	if !util.Array2DEquals(sortedPolicy(enforcerPolicy), sortedPolicy(want)) {
+		t.Fatalf("Want %v but got %v", want, enforcerPolicy)
+		return
+	}
+
+	oldRules, err := adapter.UpdateFilteredPolicies("p", "p", [][]string{{"data3_admin", "data3", "read"}}, 0, "data2_admin")
+	if err != nil {
+		t.Fatalf("Cannot update filtered policies %v", err)
+		return
+	}
+	wantOldRules := [][]string{{"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+	if !util.Array2DEquals(sortedPolicy(oldRules), wantOldRules) {
+		t.Fatalf("Want %v but got %v", wantOldRules, oldRules)
+		return
+	}
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy")
+		return
+	}
+	enforcerPolicy = enforcer.GetPolicy()
+	want = [][]string{{"alice", "data1", "read"}, {"bob", "data2", "read"}, {"data3_admin", "data3", "read"}}
+	if !util.Array2DEquals(sortedPolicy(enforcerPolicy), sortedPolicy(want)) {
+		t.Fatalf("Want %v but got %v", want, enforcerPolicy)
+		return
+	}
+}
+
+func TestContextAdapter(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = NewAdapterCtx(canceledCtx, db, "casbin"); err == nil {
+		t.Fatalf("Want error when creating adapter with a canceled context")
+		return
+	}
+
+	ctx := context.Background()
+	adapter, err := NewAdapterCtx(ctx, db, "casbin")
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", "./example/policy.csv")
+	if err != nil {
+		t.Fatal("Cannot create enforcer")
+		return
+	}
+	if err = adapter.SavePolicyCtx(ctx, enforcer.GetModel()); err != nil {
+		t.Fatalf("Cannot initial policy %v", err)
+		return
+	}
+	if err = adapter.AddPolicyCtx(ctx, "p", "p", []string{"alice", "data1", "write"}); err != nil {
+		t.Fatalf("Cannot add policy %v", err)
+		return
+	}
+	if err = adapter.AddPolicyCtx(canceledCtx, "p", "p", []string{"bob", "data1", "write"}); err == nil {
+		t.Fatalf("Want error when adding policy with a canceled context")
+		return
+	}
+	if err = adapter.LoadPolicyCtx(canceledCtx, enforcer.GetModel()); err == nil {
+		t.Fatalf("Want error when loading policy with a canceled context")
+		return
+	}
+
+	enforcer, err = casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	enforcerPolicy := enforcer.GetPolicy()
+	want := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"alice", "data1", "write"}}
+	if !util.Array2DEquals(enforcerPolicy, want) {
+		t.Fatalf("Want %v but got %v", want, enforcerPolicy)
+		return
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_migrate, casbin_migrate_migrations, casbin_migrate_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+
+	// Instances starting at once must not race each other.
+	errs := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := NewAdapter(db, "casbin_migrate")
+			errs <- err
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		if err = <-errs; err != nil {
+			t.Fatalf("Cannot create adapter %v", err)
+			return
+		}
+	}
+
+	var version int
+	var count int
+	if err = db.QueryRow(`SELECT MAX(version), COUNT(*) FROM casbin_migrate_migrations`).Scan(&version, &count); err != nil {
+		t.Fatalf("Cannot read migrations %v", err)
+		return
+	}
+	want := migration.Migrations[len(migration.Migrations)-1].Version
+	if version != want || count != len(migration.Migrations) {
+		t.Fatalf("Want version %v with %v migrations but got version %v with %v migrations", want, len(migration.Migrations), version, count)
+		return
+	}
+}
+
+func TestAdapterWithoutAutoMigrate(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_no_migrate, casbin_no_migrate_migrations, casbin_no_migrate_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+
+	if _, err = NewAdapter(db, "casbin_no_migrate", WithAutoMigrate(false)); err == nil {
+		t.Fatalf("Want error when the table does not exist")
+		return
+	}
+	var exists bool
+	if err = db.QueryRow(`SELECT to_regclass('casbin_no_migrate') IS NOT NULL`).Scan(&exists); err != nil {
+		t.Fatalf("Cannot check table %v", err)
+		return
+	}
+	if exists {
+		t.Fatalf("Want no table to be created without auto-migrate")
+		return
+	}
+
+	if _, err = db.Exec(`CREATE TABLE casbin_no_migrate (p_type varchar(256), v0 varchar(256))`); err != nil {
+		t.Fatalf("Cannot create table %v", err)
+		return
+	}
+	if _, err = NewAdapter(db, "casbin_no_migrate", WithAutoMigrate(false)); err == nil {
+		t.Fatalf("Want error when the table is missing columns")
+		return
+	}
+
+	if _, err = db.Exec(`DROP TABLE casbin_no_migrate`); err != nil {
+		t.Fatalf("Cannot drop table %v", err)
+		return
+	}
+	if _, err = NewAdapter(db, "casbin_no_migrate"); err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	if _, err = NewAdapter(db, "casbin_no_migrate", WithAutoMigrate(false)); err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+}
+
+func TestNew(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_new, casbin_new_migrations, casbin_new_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+
+	if _, err = New(db, WithTableName("casbin_new"), WithColumnWidth(64), WithIndexes("p_type", "v0")); err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+
+	var columnWidth int
+	if err = db.QueryRow(`
+		SELECT character_maximum_length FROM information_schema.columns
+		WHERE table_schema = 'public' AND table_name = 'casbin_new' AND column_name = 'v0'
+	`).Scan(&columnWidth); err != nil {
+		t.Fatalf("Cannot read column width %v", err)
+		return
+	}
+	if columnWidth != 64 {
+		t.Fatalf("Want column width 64 but got %v", columnWidth)
+		return
+	}
+	var indexCount int
+	if err = db.QueryRow(`
+		SELECT COUNT(*) FROM pg_indexes WHERE schemaname = 'public' AND tablename = 'casbin_new'
+	`).Scan(&indexCount); err != nil {
+		t.Fatalf("Cannot count indexes %v", err)
+		return
+	}
+	if indexCount != 2 {
+		t.Fatalf("Want 2 indexes but got %v", indexCount)
+		return
+	}
+}
+
+func TestSavePolicyModes(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+
+	for _, savePolicyMode := range []SavePolicyMode{SavePolicyModeDiff, SavePolicyModeTruncate, SavePolicyModeCopy} {
+		enforcer, err := casbin.NewEnforcer("./example/model.conf", "./example/policy.csv")
+		if err != nil {
+			t.Fatal("Cannot create enforcer")
+			return
+		}
+		adapter, err := NewAdapter(db, "casbin", WithSavePolicyMode(savePolicyMode), WithCopyBatchSize(2))
+		if err != nil {
+			t.Fatalf("Cannot create adapter %v", err)
+			return
+		}
+		if err = adapter.SavePolicy(enforcer.GetModel()); err != nil {
+			t.Fatalf("Cannot initial policy %v", err)
+			return
+		}
+		// A stale rule and a duplicate of a kept rule must both be removed.
+		if err = adapter.AddPolicies("p", "p", [][]string{{"carol", "data1", "read"}, {"alice", "data1", "read"}}); err != nil {
+			t.Fatalf("Cannot add policies %v", err)
+			return
+		}
+		if _, err = enforcer.AddPolicy("bob", "data1", "read"); err != nil {
+			t.Fatalf("Cannot add policy %v", err)
+			return
+		}
+		if err = adapter.SavePolicy(enforcer.GetModel()); err != nil {
+			t.Fatalf("Cannot save policy %v", err)
+			return
+		}
+
+		var count int
+		if err = db.QueryRow(`SELECT COUNT(*) FROM casbin`).Scan(&count); err != nil {
+			t.Fatalf("Cannot count rules %v", err)
+			return
+		}
+		if count != 6 {
+			t.Fatalf("Want 6 rules with mode %v but got %v", savePolicyMode, count)
+			return
+		}
+		enforcer, err = casbin.NewEnforcer("./example/model.conf", adapter)
+		if err != nil {
+			t.Fatalf("Cannot create enforcer %v", err)
+			return
+		}
+		enforcerPolicy := enforcer.GetPolicy()
+		want := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"bob", "data1", "read"}}
+		if !util.Array2DEquals(sortedPolicy(enforcerPolicy), sortedPolicy(want)) {
+			t.Fatalf("Want %v with mode %v but got %v", want, savePolicyMode, enforcerPolicy)
+			return
+		}
+	}
+}
+
+func TestSavePolicyValues(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+
+	for _, savePolicyMode := range []SavePolicyMode{SavePolicyModeDiff, SavePolicyModeTruncate, SavePolicyModeCopy} {
+		adapter, err := NewAdapter(db, "casbin", WithSavePolicyMode(savePolicyMode))
+		if err != nil {
+			t.Fatalf("Cannot create adapter %v", err)
+			return
+		}
+		enforcer, err := casbin.NewEnforcer("./example/model.conf", adapter)
+		if err != nil {
+			t.Fatalf("Cannot create enforcer %v", err)
+			return
+		}
+
+		// More rules than fit in the bind parameters of a single statement.
+		enforcer.EnableAutoSave(false)
+		enforcer.ClearPolicy()
+		rules := make([][]string, 0, 10000)
+		for i := 0; i < 10000; i++ {
+			rules = append(rules, []string{fmt.Sprintf("user%d", i), "data1", "read"})
+		}
+		rules = append(rules, []string{"o'brien", "data1", "read"})
+		if _, err = enforcer.AddPolicies(rules); err != nil {
+			t.Fatalf("Cannot add policies %v", err)
+			return
+		}
+		if err = enforcer.SavePolicy(); err != nil {
+			t.Fatalf("Cannot save policy with mode %v: %v", savePolicyMode, err)
+			return
+		}
+		if err = enforcer.LoadPolicy(); err != nil {
+			t.Fatalf("Cannot load policy")
+			return
+		}
+		enforcerPolicy := enforcer.GetPolicy()
+		if !util.Array2DEquals(sortedPolicy(enforcerPolicy), sortedPolicy(rules)) {
+			t.Fatalf("Want %v rules with mode %v but got %v", len(rules), savePolicyMode, len(enforcerPolicy))
+			return
+		}
+
+		// Saving an empty model clears the table.
+		enforcer.ClearPolicy()
+		if err = enforcer.SavePolicy(); err != nil {
+			t.Fatalf("Cannot save empty policy with mode %v: %v", savePolicyMode, err)
+			return
+		}
+		var count int
+		if err = db.QueryRow(`SELECT COUNT(*) FROM casbin`).Scan(&count); err != nil {
+			t.Fatalf("Cannot count rules %v", err)
+			return
+		}
+		if count != 0 {
+			t.Fatalf("Want no rules with mode %v but got %v", savePolicyMode, count)
+			return
+		}
+	}
+}
+
+func TestFieldCount(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_wide, casbin_wide_migrations, casbin_wide_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	if _, err = NewAdapter(db, "casbin_wide"); err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+
+	// The columns beyond v5 are added to the existing table.
+	adapter, err := NewAdapter(db, "casbin_wide", WithFieldCount(8))
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	if _, err = NewAdapter(db, "casbin_wide", WithFieldCount(8), WithAutoMigrate(false)); err != nil {
+		t.Fatalf("Cannot verify migrated table %v", err)
+		return
+	}
+	m, err := casbinmodel.NewModelFromString(`
+[request_definition]
+r = sub, dom, obj, act, region, tier, owner, env
+
+[policy_definition]
+p = sub, dom, obj, act, region, tier, owner, env
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && r.dom == p.dom && r.obj == p.obj && r.act == p.act && r.region == p.region && r.tier == p.tier && r.owner == p.owner && r.env == p.env
+`)
+	if err != nil {
+		t.Fatalf("Cannot create model %v", err)
+		return
+	}
+	enforcer, err := casbin.NewEnforcer(m, adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	rule := []string{"alice", "domain1", "data1", "read", "eu", "gold", "bob", "prod"}
+	if _, err = enforcer.AddPolicy(rule); err != nil {
+		t.Fatalf("Cannot add policy %v", err)
+		return
+	}
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy %v", err)
+		return
+	}
+	if !util.Array2DEquals(enforcer.GetPolicy(), [][]string{rule}) {
+		t.Fatalf("Want %v but got %v", [][]string{rule}, enforcer.GetPolicy())
+		return
+	}
+	if ok, _ := enforcer.Enforce("alice", "domain1", "data1", "read", "eu", "gold", "bob", "prod"); !ok {
+		t.Fatalf("Want alice to be allowed")
+		return
+	}
+	if err = enforcer.SavePolicy(); err != nil {
+		t.Fatalf("Cannot save policy %v", err)
+		return
+	}
+	if _, err = enforcer.RemovePolicy(rule); err != nil {
+		t.Fatalf("Cannot remove policy %v", err)
+		return
+	}
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy %v", err)
+		return
+	}
+	if len(enforcer.GetPolicy()) != 0 {
+		t.Fatalf("Want no policy but got %v", enforcer.GetPolicy())
+		return
+	}
+
+	// A table with fewer value columns rejects longer rules.
+	narrowAdapter, err := NewAdapter(db, "casbin_wide")
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	if err = narrowAdapter.AddPolicy("p", "p", rule); err == nil {
+		t.Fatalf("Want error when a rule has more fields than the table")
+		return
+	}
+}
+
+func TestEmptyFields(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_empty, casbin_empty_migrations, casbin_empty_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+
+	// Rows written before the value columns were nullable keep their empty
+	// values, but not their trailing ones.
+	table := migration.Table{Schema: "public", Name: "casbin_empty", ColumnWidth: 256, FieldCount: 6}
+	if err = migration.Migrate(context.Background(), db, table, migration.Migrations[:1], stdLogger{}); err != nil {
+		t.Fatalf("Cannot create table %v", err)
+		return
+	}
+	if _, err = db.Exec(`INSERT INTO casbin_empty (p_type, v0, v1, v2) VALUES ('p', 'bob', '', 'write')`); err != nil {
+		t.Fatalf("Cannot insert rule %v", err)
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin_empty")
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	want := [][]string{{"bob", "", "write"}}
+	if !util.Array2DEquals(enforcer.GetPolicy(), want) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetPolicy())
+		return
+	}
+
+	rules := [][]string{{"alice", "", "read"}, {"alice", "data1", ""}}
+	if _, err = enforcer.AddPolicies(rules); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy %v", err)
+		return
+	}
+	want = append(want, rules...)
+	if !util.Array2DEquals(sortedPolicy(enforcer.GetPolicy()), sortedPolicy(want)) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetPolicy())
+		return
+	}
+
+	if err = enforcer.SavePolicy(); err != nil {
+		t.Fatalf("Cannot save policy %v", err)
+		return
+	}
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy %v", err)
+		return
+	}
+	if !util.Array2DEquals(sortedPolicy(enforcer.GetPolicy()), sortedPolicy(want)) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetPolicy())
+		return
+	}
+}
+
+func TestLoadPolicyValuesWithSeparators(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_separators, casbin_separators_migrations, casbin_separators_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin_separators")
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	rules := [][]string{
+		{"alice", "/data/{id}, /files/*", "read"},
+		{"bob", `{"owner": "bob", "tags": ["a", "b"]}`, "write"},
+		{`"carol"`, "data#1", " read"},
+	}
+	if err = adapter.AddPolicies("p", "p", rules); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	if !util.Array2DEquals(sortedPolicy(enforcer.GetPolicy()), sortedPolicy(rules)) {
+		t.Fatalf("Want %v but got %v", rules, enforcer.GetPolicy())
+		return
+	}
+
+	filteredAdapter, err := NewFilteredAdapter(db, "casbin_separators")
+	if err != nil {
+		t.Fatalf("Cannot create filtered adapter %v", err)
+		return
+	}
+	filteredEnforcer, err := casbin.NewEnforcer("./example/model.conf", filteredAdapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	if err = filteredEnforcer.LoadFilteredPolicy(&model.Filter{P: []string{"bob"}}); err != nil {
+		t.Fatalf("Cannot load filtered policy %v", err)
+		return
+	}
+	want := rules[1:2]
+	if !util.Array2DEquals(filteredEnforcer.GetPolicy(), want) {
+		t.Fatalf("Want %v but got %v", want, filteredEnforcer.GetPolicy())
+		return
+	}
+}
+
+func TestRemovePolicySemantics(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_remove, casbin_remove_migrations, casbin_remove_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin_remove")
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	rules := [][]string{
+		{"alice", "data1"},
+		{"alice", "data1", "read"},
+		{"alice", "data1", "write"},
+		{"alice", "", "read"},
+		{"alice", "data2", "read"},
+	}
+	if err = adapter.AddPolicies("p", "p", rules); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	loadRules := func() [][]string {
+		casbinRules, err := adapter.casbinRuleRepository.LoadAllCasbinRules()
+		if err != nil {
+			t.Fatalf("Cannot load rules %v", err)
+		}
+		loaded := make([][]string, 0, len(casbinRules))
+		for _, casbinRule := range casbinRules {
+			loaded = append(loaded, casbinRule.ToStringSlice()[1:])
+		}
+		return sortedPolicy(loaded)
+	}
+
+	// RemovePolicy only deletes the row holding exactly the given fields.
+	if err = adapter.RemovePolicy("p", "p", []string{"alice", "data1"}); err != nil {
+		t.Fatalf("Cannot remove policy %v", err)
+		return
+	}
+	want := sortedPolicy(rules[1:])
+	if got := loadRules(); !util.Array2DEquals(got, want) {
+		t.Fatalf("Want %v but got %v", want, got)
+		return
+	}
+	if err = adapter.RemovePolicies("p", "p", [][]string{{"alice", "", "read"}}); err != nil {
+		t.Fatalf("Cannot remove policies %v", err)
+		return
+	}
+	want = sortedPolicy(rules[1:3:3])
+	want = sortedPolicy(append(want, rules[4]))
+	if got := loadRules(); !util.Array2DEquals(got, want) {
+		t.Fatalf("Want %v but got %v", want, got)
+		return
+	}
+
+	// RemoveFilteredPolicy treats empty fields as wildcards.
+	if err = adapter.RemoveFilteredPolicy("p", "p", 0, "alice", "", "read"); err != nil {
+		t.Fatalf("Cannot remove filtered policy %v", err)
+		return
+	}
+	want = [][]string{{"alice", "data1", "write"}}
+	if got := loadRules(); !util.Array2DEquals(got, want) {
+		t.Fatalf("Want %v but got %v", want, got)
+		return
+	}
+}
+
+func TestConditionFilter(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_condition, casbin_condition_migrations, casbin_condition_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	adapter, err := NewFilteredAdapter(db, "casbin_condition")
+	if err != nil {
+		t.Fatalf("Cannot create filtered adapter %v", err)
+		return
+	}
+	rules := [][]string{
+		{"alice", "dom_1", "read"},
+		{"bob", "domx1", "read"},
+		{"carol", "dom_1", "write"},
+		{"dave", "dom_2", "read"},
+		{"erin", "other", "read"},
+	}
+	if err = adapter.AddPolicies("p", "p", rules); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+
+	tests := []struct {
+		filter *model.ConditionFilter
+		want   [][]string
+	}{
+		{&model.ConditionFilter{P: []model.Condition{{}, model.Equals("dom_1")}}, [][]string{rules[0], rules[2]}},
+		{&model.ConditionFilter{P: []model.Condition{{}, model.Prefix("dom_")}}, [][]string{rules[0], rules[2], rules[3]}},
+		{&model.ConditionFilter{P: []model.Condition{{}, model.Like("dom_1")}}, [][]string{rules[0], rules[1], rules[2]}},
+		{&model.ConditionFilter{P: []model.Condition{{}, model.Regex("^dom_[0-9]$"), model.NotEquals("write")}}, [][]string{rules[0], rules[3]}},
+		{&model.ConditionFilter{P: []model.Condition{model.In("alice", "erin", "zoe")}}, [][]string{rules[0], rules[4]}},
+	}
+	for _, test := range tests {
+		if err = enforcer.LoadFilteredPolicy(test.filter); err != nil {
+			t.Fatalf("Cannot load filtered policy %v", err)
+			return
+		}
+		if !util.Array2DEquals(sortedPolicy(enforcer.GetPolicy()), sortedPolicy(test.want)) {
+			t.Fatalf("Want %v but got %v", test.want, enforcer.GetPolicy())
+			return
+		}
+	}
+}
+
+func TestPTypeFilter(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_ptype, casbin_ptype_migrations, casbin_ptype_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	adapter, err := NewFilteredAdapter(db, "casbin_ptype")
+	if err != nil {
+		t.Fatalf("Cannot create filtered adapter %v", err)
+		return
+	}
+	m, err := casbinmodel.NewModelFromString(`
+[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[role_definition]
+g = _, _
+g2 = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = g(r.sub, p.sub) && g2(r.obj, p.obj) && r.act == p.act
+`)
+	if err != nil {
+		t.Fatalf("Cannot create model %v", err)
+		return
+	}
+	if err = adapter.AddPolicies("p", "p", [][]string{{"admin", "docs", "read"}}); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	if err = adapter.AddPolicies("g", "g", [][]string{{"alice", "admin"}, {"bob", "admin"}}); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	if err = adapter.AddPolicies("g", "g2", [][]string{{"doc1", "docs"}, {"alice", "docs"}}); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	enforcer, err := casbin.NewEnforcer(m, adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+
+	// The filter on g does not apply to g2, and p is not loaded.
+	err = enforcer.LoadFilteredPolicy(map[string][]string{
+		"g":  {"alice"},
+		"g2": {},
+	})
+	if err != nil {
+		t.Fatalf("Cannot load filtered policy %v", err)
+		return
+	}
+	if len(enforcer.GetPolicy()) != 0 {
+		t.Fatalf("Want no p rules but got %v", enforcer.GetPolicy())
+		return
+	}
+	want := [][]string{{"alice", "admin"}}
+	if !util.Array2DEquals(enforcer.GetNamedGroupingPolicy("g"), want) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetNamedGroupingPolicy("g"))
+		return
+	}
+	want = [][]string{{"alice", "docs"}, {"doc1", "docs"}}
+	if !util.Array2DEquals(sortedPolicy(enforcer.GetNamedGroupingPolicy("g2")), want) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetNamedGroupingPolicy("g2"))
+		return
+	}
+
+	err = enforcer.LoadFilteredPolicy(model.PTypeFilter{
+		"p":  nil,
+		"g2": {model.Prefix("doc")},
+	})
+	if err != nil {
+		t.Fatalf("Cannot load filtered policy %v", err)
+		return
+	}
+	if len(enforcer.GetNamedGroupingPolicy("g")) != 0 {
+		t.Fatalf("Want no g rules but got %v", enforcer.GetNamedGroupingPolicy("g"))
+		return
+	}
+	want = [][]string{{"doc1", "docs"}}
+	if !util.Array2DEquals(enforcer.GetNamedGroupingPolicy("g2"), want) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetNamedGroupingPolicy("g2"))
+		return
+	}
+	want = [][]string{{"admin", "docs", "read"}}
+	if !util.Array2DEquals(enforcer.GetPolicy(), want) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetPolicy())
+		return
+	}
+}
+
+func TestLoadIncrementalFilteredPolicy(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_incremental, casbin_incremental_migrations, casbin_incremental_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	adapter, err := NewFilteredAdapter(db, "casbin_incremental")
+	if err != nil {
+		t.Fatalf("Cannot create filtered adapter %v", err)
+		return
+	}
+	rules := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"carol", "data3", "read"}}
+	if err = adapter.AddPolicies("p", "p", rules); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+
+	aliceFilter := &model.Filter{P: []string{"alice"}}
+	bobFilter := model.PTypeFilter{"p": {model.Equals("bob")}}
+	if err = enforcer.LoadFilteredPolicy(aliceFilter); err != nil {
+		t.Fatalf("Cannot load filtered policy %v", err)
+		return
+	}
+	if err = enforcer.LoadIncrementalFilteredPolicy(bobFilter); err != nil {
+		t.Fatalf("Cannot load incremental filtered policy %v", err)
+		return
+	}
+	// Applying a filter again does not duplicate its rules.
+	if err = enforcer.LoadIncrementalFilteredPolicy(aliceFilter); err != nil {
+		t.Fatalf("Cannot load incremental filtered policy %v", err)
+		return
+	}
+	want := rules[:2]
+	if !util.Array2DEquals(sortedPolicy(enforcer.GetPolicy()), want) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetPolicy())
+		return
+	}
+	if ok, _ := enforcer.Enforce("bob", "data2", "write"); !ok {
+		t.Fatalf("Want bob to be allowed")
+		return
+	}
+	if ok, _ := enforcer.Enforce("carol", "data3", "read"); ok {
+		t.Fatalf("Want carol to be denied")
+		return
+	}
+	if !adapter.IsFiltered() || len(adapter.Filters()) != 3 {
+		t.Fatalf("Want 3 filters applied but got %v", adapter.Filters())
+		return
+	}
+
+	if err = enforcer.LoadFilteredPolicy(bobFilter); err != nil {
+		t.Fatalf("Cannot load filtered policy %v", err)
+		return
+	}
+	if len(adapter.Filters()) != 1 {
+		t.Fatalf("Want 1 filter applied but got %v", adapter.Filters())
+		return
+	}
+
+	// A filter matching no rule leaves the model empty, but is still applied
+	// when the rules of another filter are added.
+	noneFilter := &model.Filter{P: []string{"dave"}}
+	if err = enforcer.LoadFilteredPolicy(noneFilter); err != nil {
+		t.Fatalf("Cannot load filtered policy %v", err)
+		return
+	}
+	if err = enforcer.LoadIncrementalFilteredPolicy(bobFilter); err != nil {
+		t.Fatalf("Cannot load incremental filtered policy %v", err)
+		return
+	}
+	if !util.Array2DEquals(enforcer.GetPolicy(), rules[1:2]) {
+		t.Fatalf("Want %v but got %v", rules[1:2], enforcer.GetPolicy())
+		return
+	}
+	if !adapter.IsFiltered() || len(adapter.Filters()) != 2 {
+		t.Fatalf("Want 2 filters applied but got %v", adapter.Filters())
+		return
+	}
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy %v", err)
+		return
+	}
+	if adapter.IsFiltered() || len(adapter.Filters()) != 0 {
+		t.Fatalf("Want no filters applied but got %v", adapter.Filters())
+		return
+	}
+
+	// Adding the rules of a filter to the policy loaded in full keeps it
+	// unfiltered, so that saving it still removes the rules outside the filter.
+	if err = enforcer.LoadIncrementalFilteredPolicy(bobFilter); err != nil {
+		t.Fatalf("Cannot load incremental filtered policy %v", err)
+		return
+	}
+	if enforcer.IsFiltered() || len(adapter.Filters()) != 0 {
+		t.Fatalf("Want no filters applied but got %v", adapter.Filters())
+		return
+	}
+	enforcer.EnableAutoSave(false)
+	if _, err = enforcer.RemovePolicy("carol", "data3", "read"); err != nil {
+		t.Fatalf("Cannot remove policy %v", err)
+		return
+	}
+	if err = enforcer.SavePolicy(); err != nil {
+		t.Fatalf("Cannot save policy %v", err)
+		return
+	}
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy %v", err)
+		return
+	}
+	if !util.Array2DEquals(sortedPolicy(enforcer.GetPolicy()), want) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetPolicy())
+		return
+	}
+}
+
+func TestFilteredSavePolicy(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_scoped, casbin_scoped_migrations, casbin_scoped_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	adapter, err := NewFilteredAdapter(db, "casbin_scoped")
+	if err != nil {
+		t.Fatalf("Cannot create filtered adapter %v", err)
+		return
+	}
+	rules := [][]string{
+		{"alice", "tenant1", "read"},
+		{"bob", "tenant1", "write"},
+		{"carol", "tenant2", "read"},
+		{"dave", "tenant3", "read"},
+	}
+	if err = adapter.AddPolicies("p", "p", rules); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	if err = enforcer.LoadFilteredPolicy(map[string][]string{"p": {"", "tenant1"}}); err != nil {
+		t.Fatalf("Cannot load filtered policy %v", err)
+		return
+	}
+	if err = enforcer.LoadIncrementalFilteredPolicy(&model.ConditionFilter{P: []model.Condition{{}, model.Equals("tenant2")}}); err != nil {
+		t.Fatalf("Cannot load incremental filtered policy %v", err)
+		return
+	}
+
+	// dave is outside the filters, so saving neither removes nor duplicates him.
+	enforcer.EnableAutoSave(false)
+	if _, err = enforcer.RemovePolicy("bob", "tenant1", "write"); err != nil {
+		t.Fatalf("Cannot remove policy %v", err)
+		return
+	}
+	if _, err = enforcer.AddPolicies([][]string{{"erin", "tenant2", "write"}, {"dave", "tenant3", "read"}}); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	if err = adapter.SavePolicy(enforcer.GetModel()); err != nil {
+		t.Fatalf("Cannot save filtered policy %v", err)
+		return
+	}
+
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy %v", err)
+		return
+	}
+	want := [][]string{
+		{"alice", "tenant1", "read"},
+		{"carol", "tenant2", "read"},
+		{"dave", "tenant3", "read"},
+		{"erin", "tenant2", "write"},
+	}
+	if !util.Array2DEquals(sortedPolicy(enforcer.GetPolicy()), want) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetPolicy())
+		return
+	}
+	var count int
+	if err = db.QueryRow(`SELECT COUNT(*) FROM casbin_scoped`).Scan(&count); err != nil {
+		t.Fatalf("Cannot count rules %v", err)
+		return
+	}
+	if count != len(want) {
+		t.Fatalf("Want %v rows but got %v", len(want), count)
+		return
+	}
+}
+
+func TestTenantAdapter(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_tenant, casbin_tenant_migrations, casbin_tenant_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	if _, err = NewAdapter(db, "casbin_tenant"); err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	if _, err = NewAdapter(db, "casbin_tenant", WithTenantColumn(true), WithAutoMigrate(false)); err == nil {
+		t.Fatalf("Want error when the table has no tenant column")
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin_tenant", WithTenantColumn(true))
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	tenant1, err := adapter.ForTenant("tenant1")
+	if err != nil {
+		t.Fatalf("Cannot create tenant adapter %v", err)
+		return
+	}
+	tenant2, err := adapter.ForTenant("tenant2")
+	if err != nil {
+		t.Fatalf("Cannot create tenant adapter %v", err)
+		return
+	}
+
+	rules := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}}
+	for _, tenantAdapter := range []*Adapter{tenant1, tenant2} {
+		if err = tenantAdapter.AddPolicies("p", "p", rules); err != nil {
+			t.Fatalf("Cannot add policies %v", err)
+			return
+		}
+	}
+	if err = tenant1.RemovePolicy("p", "p", rules[0]); err != nil {
+		t.Fatalf("Cannot remove policy %v", err)
+		return
+	}
+	if err = tenant1.RemoveFilteredPolicy("p", "p", 1, "data2"); err != nil {
+		t.Fatalf("Cannot remove filtered policy %v", err)
+		return
+	}
+	if err = tenant1.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("Cannot add policy %v", err)
+		return
+	}
+
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", tenant1)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	want := [][]string{{"carol", "data3", "read"}}
+	if !util.Array2DEquals(enforcer.GetPolicy(), want) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetPolicy())
+		return
+	}
+	for _, savePolicyMode := range []SavePolicyMode{SavePolicyModeDiff, SavePolicyModeTruncate, SavePolicyModeCopy} {
+		tenant1.options.savePolicyMode = savePolicyMode
+		if err = tenant1.SavePolicy(enforcer.GetModel()); err != nil {
+			t.Fatalf("Cannot save policy with mode %v: %v", savePolicyMode, err)
+			return
+		}
+	}
+
+	// The rules of the other tenants are left untouched.
+	enforcer, err = casbin.NewEnforcer("./example/model.conf", tenant2)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	if !util.Array2DEquals(sortedPolicy(enforcer.GetPolicy()), rules) {
+		t.Fatalf("Want %v but got %v", rules, enforcer.GetPolicy())
+		return
+	}
+	enforcer, err = casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	if len(enforcer.GetPolicy()) != 0 {
+		t.Fatalf("Want no rules for the empty tenant but got %v", enforcer.GetPolicy())
+		return
+	}
+	var count int
+	if err = db.QueryRow(`SELECT COUNT(*) FROM casbin_tenant`).Scan(&count); err != nil {
+		t.Fatalf("Cannot count rules %v", err)
+		return
+	}
+	if count != 3 {
+		t.Fatalf("Want 3 rows but got %v", count)
+		return
+	}
+}
+
+func TestRowLevelSecurity(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_rls, casbin_rls_migrations, casbin_rls_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	if _, err = NewAdapter(db, "casbin_rls", WithTenantColumn(true)); err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	if _, err = NewAdapter(db, "casbin_rls", WithTenantColumn(true), WithRowLevelSecurity("app.tenant"), WithAutoMigrate(false)); err == nil {
+		t.Fatalf("Want error when the table has no row level security")
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin_rls", WithTenantColumn(true), WithRowLevelSecurity("app.tenant"))
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	policyOID := func() (oid int64) {
+		err = db.QueryRow(`SELECT oid FROM pg_policy WHERE polrelid = 'casbin_rls'::regclass AND polname = 'casbin_rls_tenant_isolation'`).Scan(&oid)
+		if err != nil {
+			t.Fatalf("Cannot read the tenant isolation policy %v", err)
+		}
+		return oid
+	}
+	oid := policyOID()
+	// Migrating again leaves the policy as it is.
+	if _, err = NewAdapter(db, "casbin_rls", WithTenantColumn(true), WithRowLevelSecurity("app.tenant")); err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	if policyOID() != oid {
+		t.Fatalf("Want the tenant isolation policy to be kept")
+		return
+	}
+	// Migrating with another setting replaces it.
+	if _, err = NewAdapter(db, "casbin_rls", WithTenantColumn(true), WithRowLevelSecurity("app.other_tenant")); err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	if policyOID() == oid {
+		t.Fatalf("Want the tenant isolation policy to be replaced")
+		return
+	}
+	if _, err = NewAdapter(db, "casbin_rls", WithTenantColumn(true), WithRowLevelSecurity("app.tenant")); err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+
+	tenant1, err := adapter.ForTenant("tenant1")
+	if err != nil {
+		t.Fatalf("Cannot create tenant adapter %v", err)
+		return
+	}
+	tenant2, err := adapter.ForTenant("tenant2")
+	if err != nil {
+		t.Fatalf("Cannot create tenant adapter %v", err)
+		return
+	}
+	rules := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}}
+	for _, tenantAdapter := range []*Adapter{tenant1, tenant2} {
+		if err = tenantAdapter.AddPolicies("p", "p", rules); err != nil {
+			t.Fatalf("Cannot add policies %v", err)
+			return
+		}
+	}
+	if err = tenant1.RemovePolicy("p", "p", rules[0]); err != nil {
+		t.Fatalf("Cannot remove policy %v", err)
+		return
+	}
+	if err = tenant1.UpdatePolicy("p", "p", rules[1], []string{"bob", "data3", "write"}); err != nil {
+		t.Fatalf("Cannot update policy %v", err)
+		return
+	}
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", tenant1)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	want := [][]string{{"bob", "data3", "write"}}
+	if !util.Array2DEquals(enforcer.GetPolicy(), want) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetPolicy())
+		return
+	}
+	if err = tenant1.SavePolicy(enforcer.GetModel()); err != nil {
+		t.Fatalf("Cannot save policy %v", err)
+		return
+	}
+	enforcer, err = casbin.NewEnforcer("./example/model.conf", tenant2)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	if !util.Array2DEquals(sortedPolicy(enforcer.GetPolicy()), rules) {
+		t.Fatalf("Want %v but got %v", rules, enforcer.GetPolicy())
+		return
+	}
+
+	// Superusers and roles with BYPASSRLS are not bound by the policy, so the
+	// rows are read as a role without either.
+	_, err = db.Exec(`
+		DO $$ BEGIN
+			CREATE ROLE casbin_rls_user NOLOGIN NOSUPERUSER NOBYPASSRLS;
+		EXCEPTION WHEN duplicate_object THEN NULL;
+		END $$
+	`)
+	if err != nil {
+		t.Fatalf("Cannot create role %v", err)
+		return
+	}
+	if _, err = db.Exec(`GRANT SELECT, INSERT ON casbin_rls TO casbin_rls_user`); err != nil {
+		t.Fatalf("Cannot grant role %v", err)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Cannot begin transaction %v", err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`SET LOCAL ROLE casbin_rls_user`); err != nil {
+		t.Fatalf("Cannot set role %v", err)
+		return
+	}
+	var count int
+	if err = tx.QueryRow(`SELECT COUNT(*) FROM casbin_rls`).Scan(&count); err != nil {
+		t.Fatalf("Cannot count rules %v", err)
+		return
+	}
+	if count != 0 {
+		t.Fatalf("Want no rows without the session variable but got %v", count)
+		return
+	}
+	if _, err = tx.Exec(`SELECT set_config('app.tenant', 'tenant2', true)`); err != nil {
+		t.Fatalf("Cannot set tenant %v", err)
+		return
+	}
+	if err = tx.QueryRow(`SELECT COUNT(*) FROM casbin_rls`).Scan(&count); err != nil {
+		t.Fatalf("Cannot count rules %v", err)
+		return
+	}
+	if count != 2 {
+		t.Fatalf("Want 2 rows of tenant2 but got %v", count)
+		return
+	}
+	_, err = tx.Exec(`INSERT INTO casbin_rls (p_type, v0, tenant_id) VALUES ('p', 'eve', 'tenant1')`)
+	if err == nil {
+		t.Fatalf("Want error when inserting a rule of another tenant")
+		return
+	}
+}
+
+func TestLoadPolicyAsOf(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_temporal, casbin_temporal_migrations, casbin_temporal_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin_temporal", WithTemporal(true))
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	// instant returns the current time of the database, between the
+	// transactions of the adapter
+	instant := func() time.Time {
+		var now time.Time
+		if err := db.QueryRow(`SELECT clock_timestamp()`).Scan(&now); err != nil {
+			t.Fatalf("Cannot get time %v", err)
+		}
+		return now
+	}
+
+	beforeAll := instant()
+	if err = adapter.AddPolicies("p", "p", [][]string{{"bob", "data2", "write"}, {"alice", "data1", "read"}}); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	afterAdd := instant()
+	if err = adapter.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatalf("Cannot remove policy %v", err)
+		return
+	}
+	if err = adapter.UpdatePolicy("p", "p", []string{"bob", "data2", "write"}, []string{"bob", "data2", "read"}); err != nil {
+		t.Fatalf("Cannot update policy %v", err)
+		return
+	}
+	afterUpdate := instant()
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	if _, err = enforcer.AddGroupingPolicy("carol", "admin"); err != nil {
+		t.Fatalf("Cannot add grouping policy %v", err)
+		return
+	}
+	enforcer.GetModel().ClearPolicy()
+	enforcer.GetModel().AddPolicy("p", "p", []string{"dave", "data3", "read"})
+	for _, savePolicyMode := range []SavePolicyMode{SavePolicyModeDiff, SavePolicyModeTruncate} {
+		adapter.options.savePolicyMode = savePolicyMode
+		if err = adapter.SavePolicy(enforcer.GetModel()); err != nil {
+			t.Fatalf("Cannot save policy with mode %v: %v", savePolicyMode, err)
+			return
+		}
+	}
+
+	tests := []struct {
+		asOf      time.Time
+		policy    [][]string
+		groupings [][]string
+	}{
+		{beforeAll, [][]string{}, [][]string{}},
+		// The rules are loaded in the order they were inserted.
+		{afterAdd, [][]string{{"bob", "data2", "write"}, {"alice", "data1", "read"}}, [][]string{}},
+		{afterUpdate, [][]string{{"bob", "data2", "read"}}, [][]string{}},
+		{instant(), [][]string{{"dave", "data3", "read"}}, [][]string{}},
+	}
+	for _, test := range tests {
+		if err = adapter.LoadPolicyAsOf(enforcer.GetModel(), test.asOf); err != nil {
+			t.Fatalf("Cannot load policy as of %v: %v", test.asOf, err)
+			return
+		}
+		if !util.Array2DEquals(enforcer.GetPolicy(), test.policy) {
+			t.Fatalf("Want %v as of %v but got %v", test.policy, test.asOf, enforcer.GetPolicy())
+			return
+		}
+		if !util.Array2DEquals(enforcer.GetGroupingPolicy(), test.groupings) {
+			t.Fatalf("Want %v as of %v but got %v", test.groupings, test.asOf, enforcer.GetGroupingPolicy())
+			return
+		}
+	}
+
+	// LoadPolicy only sees the current rows, while the rows removed are kept.
+	if err = enforcer.LoadPolicy(); err != nil {
+		t.Fatalf("Cannot load policy %v", err)
+		return
+	}
+	want := [][]string{{"dave", "data3", "read"}}
+	if !util.Array2DEquals(enforcer.GetPolicy(), want) || len(enforcer.GetGroupingPolicy()) != 0 {
+		t.Fatalf("Want %v but got %v %v", want, enforcer.GetPolicy(), enforcer.GetGroupingPolicy())
+		return
+	}
+	var count int
+	if err = db.QueryRow(`SELECT COUNT(*) FROM casbin_temporal`).Scan(&count); err != nil {
+		t.Fatalf("Cannot count rules %v", err)
+		return
+	}
+	if count != 6 {
+		t.Fatalf("Want 6 rows but got %v", count)
+		return
+	}
+
+	notTemporal, err := NewAdapter(db, "casbin_temporal")
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	if err = notTemporal.LoadPolicyAsOf(enforcer.GetModel(), instant()); err == nil {
+		t.Fatalf("Want error when the adapter is not temporal")
+		return
+	}
+}
+
+func TestBulkInsertCasbinRules(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_bulk, casbin_bulk_migrations, casbin_bulk_migration_options`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin_bulk", WithColumnWidth(16))
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	casbinRuleRepository := adapter.casbinRuleRepository
+	count := func() int {
+		var count int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM casbin_bulk`).Scan(&count); err != nil {
+			t.Fatalf("Cannot count rules %v", err)
+		}
+		return count
+	}
+
+	casbinRules := make([]model.CasbinRule, 0)
+	for i := 0; i < 6; i++ {
+		casbinRules = append(casbinRules, model.NewCasbinRuleFromPTypeAndRule("p", []string{fmt.Sprintf("user%d", i), "data1", "read"}))
+	}
+	// Batches ending exactly on the last rule, leaving one rule over, and
+	// holding every rule at once.
+	total := 0
+	for _, batchSize := range []int{3, 5, 6, 100} {
+		if err = casbinRuleRepository.BulkInsertCasbinRules(casbinRules, batchSize); err != nil {
+			t.Fatalf("Cannot bulk insert with batch size %v: %v", batchSize, err)
+			return
+		}
+		total += len(casbinRules)
+		if got := count(); got != total {
+			t.Fatalf("Want %v rows with batch size %v but got %v", total, batchSize, got)
+			return
+		}
+	}
+	if err = casbinRuleRepository.BulkInsertCasbinRules(nil, 3); err != nil {
+		t.Fatalf("Cannot bulk insert no rules %v", err)
+		return
+	}
+
+	for _, batchSize := range []int{0, -1} {
+		if err = casbinRuleRepository.BulkInsertCasbinRules(casbinRules, batchSize); err == nil {
+			t.Fatalf("Want error for batch size %v", batchSize)
+			return
+		}
+	}
+
+	// A value longer than the column fails its batch, and every batch before
+	// it is rolled back with it.
+	invalidCasbinRules := append(append([]model.CasbinRule(nil), casbinRules...),
+		model.NewCasbinRuleFromPTypeAndRule("p", []string{strings.Repeat("a", 17), "data1", "read"}))
+	if err = casbinRuleRepository.BulkInsertCasbinRules(invalidCasbinRules, 2); err == nil {
+		t.Fatalf("Want error for a value longer than the column")
+		return
+	}
+	if got := count(); got != total {
+		t.Fatalf("Want %v rows after the rollback but got %v", total, got)
+		return
+	}
+}
@@ -0,0 +1,41 @@
+package casbinpgadapter
+
+import (
+	"context"
+
+	"github.com/cychiuae/casbin-pg-adapter/pkg/model"
+	"github.com/cychiuae/casbin-pg-adapter/pkg/repository"
+)
+
+// WithActor returns a copy of ctx carrying actor, such as the id of the user
+// making a change. The audit log records it for the changes made through the
+// ...Ctx methods of the adapter with the returned context.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return repository.WithActor(ctx, actor)
+}
+
+// AuditLog returns the page of the audit log of the tenant of the adapter
+// selected by query, in the order recorded. The next page starts after the id
+// of the last entry returned. It requires WithAuditLog.
+func (adapter *Adapter) AuditLog(query model.AuditQuery) ([]model.AuditEntry, error) {
+	return adapter.AuditLogCtx(context.Background(), query)
+}
+
+// AuditLogCtx is AuditLog with a context.Context
+func (adapter *Adapter) AuditLogCtx(ctx context.Context, query model.AuditQuery) ([]model.AuditEntry, error) {
+	return adapter.casbinRuleRepository.LoadAuditEntriesCtx(ctx, query)
+}
+
+// VerifyAuditChain walks the audit log of the tenant of the adapter and returns
+// the first entry whose hash does not chain to the entry before it, which shows
+// that the log has been edited, or nil when the chain is intact. An entry
+// without a hash after the start of the chain breaks it. It requires
+// WithAuditLog, along with the WithAuditKey the entries were recorded with.
+func (adapter *Adapter) VerifyAuditChain() (*model.AuditChainBreak, error) {
+	return adapter.VerifyAuditChainCtx(context.Background())
+}
+
+// VerifyAuditChainCtx is VerifyAuditChain with a context.Context
+func (adapter *Adapter) VerifyAuditChainCtx(ctx context.Context) (*model.AuditChainBreak, error) {
+	return adapter.casbinRuleRepository.VerifyAuditChainCtx(ctx)
+}
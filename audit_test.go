@@ -0,0 +1,353 @@
+package casbinpgadapter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+
+	"github.com/cychiuae/casbin-pg-adapter/pkg/model"
+)
+
+func TestAuditLog(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_audited, casbin_audited_migrations, casbin_audited_migration_options, casbin_audited_audit, casbin_audited_audit_chain`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin_audited", WithAuditLog(true))
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	ctx := WithActor(context.Background(), "admin")
+	if err = adapter.AddPoliciesCtx(ctx, "p", "p", [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}}); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	if err = adapter.RemovePolicyCtx(ctx, "p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatalf("Cannot remove policy %v", err)
+		return
+	}
+	// Removing a rule no row holds records nothing.
+	if err = adapter.RemovePolicyCtx(ctx, "p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("Cannot remove policy %v", err)
+		return
+	}
+	if err = adapter.UpdatePolicyCtx(ctx, "p", "p", []string{"bob", "data2", "write"}, []string{"bob", "data2", "read"}); err != nil {
+		t.Fatalf("Cannot update policy %v", err)
+		return
+	}
+	if err = adapter.AddPolicy("g", "g", []string{"alice", "admin"}); err != nil {
+		t.Fatalf("Cannot add policy %v", err)
+		return
+	}
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	if _, err = enforcer.RemoveGroupingPolicy("alice", "admin"); err != nil {
+		t.Fatalf("Cannot remove grouping policy %v", err)
+		return
+	}
+	if _, err = enforcer.AddPolicy("carol", "data3", "read"); err != nil {
+		t.Fatalf("Cannot add policy %v", err)
+		return
+	}
+	adapter.options.savePolicyMode = SavePolicyModeTruncate
+	if err = adapter.SavePolicyCtx(ctx, enforcer.GetModel()); err != nil {
+		t.Fatalf("Cannot save policy %v", err)
+		return
+	}
+
+	type change struct {
+		operation model.AuditOperation
+		rule      []string
+		actor     string
+	}
+	want := []change{
+		{model.AuditOperationInsert, []string{"p", "alice", "data1", "read"}, "admin"},
+		{model.AuditOperationInsert, []string{"p", "bob", "data2", "write"}, "admin"},
+		{model.AuditOperationDelete, []string{"p", "alice", "data1", "read"}, "admin"},
+		{model.AuditOperationDelete, []string{"p", "bob", "data2", "write"}, "admin"},
+		{model.AuditOperationInsert, []string{"p", "bob", "data2", "read"}, "admin"},
+		{model.AuditOperationInsert, []string{"g", "alice", "admin"}, ""},
+		{model.AuditOperationDelete, []string{"g", "alice", "admin"}, ""},
+		{model.AuditOperationInsert, []string{"p", "carol", "data3", "read"}, ""},
+		{model.AuditOperationDelete, []string{"p", "bob", "data2", "read"}, "admin"},
+		{model.AuditOperationDelete, []string{"p", "carol", "data3", "read"}, "admin"},
+		{model.AuditOperationInsert, []string{"p", "bob", "data2", "read"}, "admin"},
+		{model.AuditOperationInsert, []string{"p", "carol", "data3", "read"}, "admin"},
+	}
+	// The log is paged through three entries at a time.
+	got := make([]change, 0)
+	query := model.AuditQuery{Limit: 3}
+	var lastID int64
+	for {
+		auditEntries, err := adapter.AuditLog(query)
+		if err != nil {
+			t.Fatalf("Cannot load audit log %v", err)
+			return
+		}
+		if len(auditEntries) == 0 {
+			break
+		}
+		for _, auditEntry := range auditEntries {
+			if auditEntry.ID <= lastID || auditEntry.Time.IsZero() {
+				t.Fatalf("Unexpected audit entry %+v", auditEntry)
+				return
+			}
+			lastID = auditEntry.ID
+			got = append(got, change{auditEntry.Operation, auditEntry.CasbinRule.ToStringSlice(), auditEntry.Actor})
+		}
+		query.AfterID = lastID
+	}
+	// The rows deleted by a single statement come in no particular order.
+	if len(got) != len(want) {
+		t.Fatalf("Want %v but got %v", want, got)
+		return
+	}
+	for i := range want {
+		if i == 8 || i == 9 {
+			continue
+		}
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Fatalf("Want %v but got %v at %d", want[i], got[i], i)
+			return
+		}
+	}
+
+	auditEntries, err := adapter.AuditLog(model.AuditQuery{PType: "g"})
+	if err != nil {
+		t.Fatalf("Cannot load audit log %v", err)
+		return
+	}
+	if len(auditEntries) != 2 {
+		t.Fatalf("Want 2 entries of ptype g but got %v", auditEntries)
+		return
+	}
+	auditEntries, err = adapter.AuditLog(model.AuditQuery{Actor: "admin"})
+	if err != nil {
+		t.Fatalf("Cannot load audit log %v", err)
+		return
+	}
+	if len(auditEntries) != 9 {
+		t.Fatalf("Want 9 entries of actor admin but got %v", auditEntries)
+		return
+	}
+
+	// A failed change leaves no entry.
+	if err = adapter.AddPolicyCtx(ctx, "p", "p", make([]string, 7)); err == nil {
+		t.Fatalf("Want error when adding a rule with too many values")
+		return
+	}
+	auditEntries, err = adapter.AuditLog(model.AuditQuery{AfterID: lastID})
+	if err != nil {
+		t.Fatalf("Cannot load audit log %v", err)
+		return
+	}
+	if len(auditEntries) != 0 {
+		t.Fatalf("Want no entries but got %v", auditEntries)
+		return
+	}
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_chained, casbin_chained_migrations, casbin_chained_migration_options, casbin_chained_audit, casbin_chained_audit_chain`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin_chained", WithAuditLog(true), WithTenantColumn(true))
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	tenant1, err := adapter.ForTenant("tenant1")
+	if err != nil {
+		t.Fatalf("Cannot create tenant adapter %v", err)
+		return
+	}
+	for _, tenantAdapter := range []*Adapter{adapter, tenant1} {
+		if err = tenantAdapter.AddPolicies("p", "p", [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}}); err != nil {
+			t.Fatalf("Cannot add policies %v", err)
+			return
+		}
+		if err = tenantAdapter.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+			t.Fatalf("Cannot remove policy %v", err)
+			return
+		}
+		auditChainBreak, err := tenantAdapter.VerifyAuditChain()
+		if err != nil {
+			t.Fatalf("Cannot verify audit chain %v", err)
+			return
+		}
+		if auditChainBreak != nil {
+			t.Fatalf("Want an intact chain but got %+v", auditChainBreak)
+			return
+		}
+	}
+
+	auditEntries, err := tenant1.AuditLog(model.AuditQuery{})
+	if err != nil {
+		t.Fatalf("Cannot load audit log %v", err)
+		return
+	}
+	if len(auditEntries) != 3 {
+		t.Fatalf("Want 3 entries but got %v", auditEntries)
+		return
+	}
+	tampered := auditEntries[1]
+	_, err = db.Exec(`UPDATE casbin_chained_audit SET rule_values = '{bob,data2,read}' WHERE id = $1`, tampered.ID)
+	if err != nil {
+		t.Fatalf("Cannot tamper with audit log %v", err)
+		return
+	}
+	auditChainBreak, err := tenant1.VerifyAuditChain()
+	if err != nil {
+		t.Fatalf("Cannot verify audit chain %v", err)
+		return
+	}
+	if auditChainBreak == nil || auditChainBreak.AuditEntry.ID != tampered.ID || auditChainBreak.PreviousHash != auditEntries[0].Hash {
+		t.Fatalf("Want a break at %v but got %+v", tampered.ID, auditChainBreak)
+		return
+	}
+	// The chains of the other tenants are left intact.
+	if auditChainBreak, err = adapter.VerifyAuditChain(); err != nil || auditChainBreak != nil {
+		t.Fatalf("Want an intact chain but got %+v %v", auditChainBreak, err)
+		return
+	}
+
+	// Deleting an entry breaks the chain at the entry after it.
+	_, err = db.Exec(`UPDATE casbin_chained_audit SET rule_values = '{bob,data2,write}' WHERE id = $1`, tampered.ID)
+	if err != nil {
+		t.Fatalf("Cannot restore audit log %v", err)
+		return
+	}
+	if _, err = db.Exec(`DELETE FROM casbin_chained_audit WHERE id = $1`, auditEntries[0].ID); err != nil {
+		t.Fatalf("Cannot tamper with audit log %v", err)
+		return
+	}
+	auditChainBreak, err = tenant1.VerifyAuditChain()
+	if err != nil {
+		t.Fatalf("Cannot verify audit chain %v", err)
+		return
+	}
+	if auditChainBreak == nil || auditChainBreak.AuditEntry.ID != auditEntries[1].ID {
+		t.Fatalf("Want a break at %v but got %+v", auditEntries[1].ID, auditChainBreak)
+		return
+	}
+
+	// Clearing the hashes does not pass the entries off as recorded before the
+	// start of the chain.
+	if auditChainBreak, err = adapter.VerifyAuditChain(); err != nil || auditChainBreak != nil {
+		t.Fatalf("Want an intact chain but got %+v %v", auditChainBreak, err)
+		return
+	}
+	_, err = db.Exec(`UPDATE casbin_chained_audit SET hash = NULL, actor = 'eve' WHERE tenant_id = ''`)
+	if err != nil {
+		t.Fatalf("Cannot tamper with audit log %v", err)
+		return
+	}
+	auditChainBreak, err = adapter.VerifyAuditChain()
+	if err != nil {
+		t.Fatalf("Cannot verify audit chain %v", err)
+		return
+	}
+	if auditChainBreak == nil {
+		t.Fatalf("Want a break when the hashes are cleared")
+		return
+	}
+
+	// With a key, the chain only verifies with the same key.
+	keyed, err := NewAdapter(db, "casbin_chained", WithAuditLog(true), WithTenantColumn(true), WithAuditKey([]byte("secret")))
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	tenant2, err := keyed.ForTenant("tenant2")
+	if err != nil {
+		t.Fatalf("Cannot create tenant adapter %v", err)
+		return
+	}
+	if err = tenant2.AddPolicies("p", "p", [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}}); err != nil {
+		t.Fatalf("Cannot add policies %v", err)
+		return
+	}
+	if auditChainBreak, err = tenant2.VerifyAuditChain(); err != nil || auditChainBreak != nil {
+		t.Fatalf("Want an intact chain but got %+v %v", auditChainBreak, err)
+		return
+	}
+	unkeyed, err := adapter.ForTenant("tenant2")
+	if err != nil {
+		t.Fatalf("Cannot create tenant adapter %v", err)
+		return
+	}
+	if auditChainBreak, err = unkeyed.VerifyAuditChain(); err != nil || auditChainBreak == nil {
+		t.Fatalf("Want a break without the key but got %+v %v", auditChainBreak, err)
+		return
+	}
+}
+
+func TestAuditConcurrentChanges(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	if _, err = db.Exec(`DROP TABLE IF EXISTS casbin_raced, casbin_raced_migrations, casbin_raced_migration_options, casbin_raced_audit, casbin_raced_audit_chain`); err != nil {
+		t.Fatalf("Cannot drop tables %v", err)
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin_raced", WithAuditLog(true))
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	// Updating rules while another transaction removes one of them used to
+	// deadlock, each holding a row the other waited for while waiting for the
+	// audit lock.
+	for i := 0; i < 20; i++ {
+		rules := [][]string{{"alice", fmt.Sprintf("data%d", i), "read"}, {"bob", fmt.Sprintf("data%d", i), "write"}}
+		if err = adapter.AddPolicies("p", "p", rules); err != nil {
+			t.Fatalf("Cannot add policies %v", err)
+			return
+		}
+		newRules := [][]string{{"alice", fmt.Sprintf("data%d", i), "write"}, {"bob", fmt.Sprintf("data%d", i), "read"}}
+		var wg sync.WaitGroup
+		var updateErr, removeErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			updateErr = adapter.UpdatePolicies("p", "p", rules, newRules)
+		}()
+		go func() {
+			defer wg.Done()
+			removeErr = adapter.RemovePolicy("p", "p", rules[1])
+		}()
+		wg.Wait()
+		if updateErr != nil || removeErr != nil {
+			t.Fatalf("Cannot change policies concurrently %v %v", updateErr, removeErr)
+			return
+		}
+	}
+	auditChainBreak, err := adapter.VerifyAuditChain()
+	if err != nil || auditChainBreak != nil {
+		t.Fatalf("Want an intact chain but got %+v %v", auditChainBreak, err)
+		return
+	}
+}
@@ -1,8 +1,10 @@
 package casbinpgadapter
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 
 	casbinModel "github.com/casbin/casbin/v2/model"
 	"github.com/cychiuae/casbin-pg-adapter/pkg/model"
@@ -13,71 +15,218 @@ import (
 type FilteredAdapter struct {
 	*Adapter
 	filtered bool
+	// filters are the filters of the policy loaded, in the order applied
+	filters []interface{}
+	// loadedAll is whether all policy rules have been loaded since the last
+	// filtered load replacing the policy, in which case the policy stays
+	// unfiltered when the rules matching a filter are added to it
+	loadedAll bool
+	// holdsPolicy is whether the model held policy rules after the last load,
+	// so that finding it empty shows that it has been cleared since
+	holdsPolicy bool
 }
 
-// NewFilteredAdapter is the constructor for FilteredAdapter.
-func NewFilteredAdapter(db *sql.DB, tableName string) (*FilteredAdapter, error) {
+// NewFiltered returns a new FilteredAdapter configured by opts
+func NewFiltered(db *sql.DB, opts ...Option) (*FilteredAdapter, error) {
+	return NewFilteredCtx(context.Background(), db, opts...)
+}
+
+// NewFilteredCtx is NewFiltered with a context.Context
+func NewFilteredCtx(ctx context.Context, db *sql.DB, opts ...Option) (*FilteredAdapter, error) {
 	a := FilteredAdapter{filtered: false}
 	var err error
-	a.Adapter, err = NewAdapter(db, tableName)
+	a.Adapter, err = NewCtx(ctx, db, opts...)
 	return &a, err
 }
 
+// NewFilteredAdapter is the constructor for FilteredAdapter.
+func NewFilteredAdapter(db *sql.DB, tableName string, opts ...Option) (*FilteredAdapter, error) {
+	return NewFilteredAdapterCtx(context.Background(), db, tableName, opts...)
+}
+
+// NewFilteredAdapterCtx is NewFilteredAdapter with a context.Context
+func NewFilteredAdapterCtx(ctx context.Context, db *sql.DB, tableName string, opts ...Option) (*FilteredAdapter, error) {
+	return NewFilteredAdapterWithDBSchemaCtx(ctx, db, defaultDBSchema, tableName, opts...)
+}
+
 // NewFilteredAdapterWithDBSchema return a pointer for FilteredAdapter which has schema dbSchema
-func NewFilteredAdapterWithDBSchema(db *sql.DB, dbSchema string, tableName string) (*FilteredAdapter, error) {
-	a := FilteredAdapter{filtered: false}
-	var err error
-	a.Adapter, err = NewAdapterWithDBSchema(db, dbSchema, tableName)
-	return &a, err
+func NewFilteredAdapterWithDBSchema(db *sql.DB, dbSchema string, tableName string, opts ...Option) (*FilteredAdapter, error) {
+	return NewFilteredAdapterWithDBSchemaCtx(context.Background(), db, dbSchema, tableName, opts...)
+}
+
+// NewFilteredAdapterWithDBSchemaCtx is NewFilteredAdapterWithDBSchema with a context.Context
+func NewFilteredAdapterWithDBSchemaCtx(ctx context.Context, db *sql.DB, dbSchema string, tableName string, opts ...Option) (*FilteredAdapter, error) {
+	return NewFilteredCtx(ctx, db, append([]Option{WithDBSchema(dbSchema), WithTableName(tableName)}, opts...)...)
+}
+
+// ForTenant returns a view of a whose operations only apply to the rules of
+// tenantID, with no policy loaded yet. It requires WithTenantColumn.
+func (a *FilteredAdapter) ForTenant(tenantID string) (*FilteredAdapter, error) {
+	adapter, err := a.Adapter.ForTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return &FilteredAdapter{Adapter: adapter}, nil
 }
 
 // LoadPolicy loads all policy rules from the storage.
 func (a *FilteredAdapter) LoadPolicy(model casbinModel.Model) error {
+	return a.LoadPolicyCtx(context.Background(), model)
+}
+
+// LoadPolicyCtx is LoadPolicy with a context.Context
+func (a *FilteredAdapter) LoadPolicyCtx(ctx context.Context, model casbinModel.Model) error {
 	a.filtered = false
-	return a.Adapter.LoadPolicy(model)
+	a.filters = nil
+	if err := a.Adapter.LoadPolicyCtx(ctx, model); err != nil {
+		return err
+	}
+	a.loadedAll = true
+	a.holdsPolicy = hasPolicy(model)
+	return nil
+}
+
+// LoadPolicyAsOf replaces the policy of the model with all policy rules stored
+// at the instant asOf, like Adapter.LoadPolicyAsOf.
+func (a *FilteredAdapter) LoadPolicyAsOf(model casbinModel.Model, asOf time.Time) error {
+	return a.LoadPolicyAsOfCtx(context.Background(), model, asOf)
+}
+
+// LoadPolicyAsOfCtx is LoadPolicyAsOf with a context.Context
+func (a *FilteredAdapter) LoadPolicyAsOfCtx(ctx context.Context, model casbinModel.Model, asOf time.Time) error {
+	if err := a.Adapter.LoadPolicyAsOfCtx(ctx, model, asOf); err != nil {
+		return err
+	}
+	a.filtered = false
+	a.filters = nil
+	a.loadedAll = true
+	a.holdsPolicy = hasPolicy(model)
+	return nil
 }
 
-// LoadFilteredPolicy loads only policy rules that match the filter.
+// LoadFilteredPolicy loads only policy rules that match the filter, either a
+// *model.Filter, a *model.ConditionFilter, a model.PTypeFilter or a
+// map[string][]string of the field values of each ptype as taken by
+// model.NewPTypeFilter. Enforcer.LoadFilteredPolicy clears the policy before
+// calling it, while Enforcer.LoadIncrementalFilteredPolicy does not, so the
+// rules are added like LoadIncrementalFilteredPolicy once a policy has been
+// loaded, unless the model has been cleared since.
 func (a *FilteredAdapter) LoadFilteredPolicy(mod casbinModel.Model, filter interface{}) error {
-	mod.ClearPolicy()
+	return a.LoadFilteredPolicyCtx(context.Background(), mod, filter)
+}
+
+// LoadFilteredPolicyCtx is LoadFilteredPolicy with a context.Context
+func (a *FilteredAdapter) LoadFilteredPolicyCtx(ctx context.Context, mod casbinModel.Model, filter interface{}) error {
 	if filter == nil {
-		return a.LoadPolicy(mod)
+		return a.LoadPolicyCtx(ctx, mod)
 	}
-
-	filterValue, ok := filter.(*model.Filter)
-	if !ok {
-		return errors.New("invalid filter type")
+	// A model left empty by the loads so far, such as by a filter matching no
+	// rule, cannot be told from a cleared one, so it is taken as the policy
+	// loaded, lest the filters applied to it be dropped.
+	cleared := a.holdsPolicy && !hasPolicy(mod)
+	if (a.filtered || a.loadedAll) && !cleared {
+		return a.LoadIncrementalFilteredPolicyCtx(ctx, mod, filter)
 	}
-	err := a.loadFilteredPolicyFile(mod, filterValue)
+
+	err := a.loadFilteredPolicyFile(ctx, mod, filter)
 	if err == nil {
 		a.filtered = true
+		a.filters = []interface{}{filter}
+		a.loadedAll = false
+		a.holdsPolicy = hasPolicy(mod)
 	}
 	return err
 }
 
-func (a *FilteredAdapter) loadFilteredPolicyFile(model casbinModel.Model, filter *model.Filter) error {
-	casbinRules, err := a.casbinRuleRepository.LoadFilteredRules(filter)
-	if err != nil {
-		return err
+// hasPolicy reports whether mod holds any policy rule
+func hasPolicy(mod casbinModel.Model) bool {
+	for _, sec := range []string{"p", "g"} {
+		for _, assertion := range mod[sec] {
+			if len(assertion.Policy) > 0 {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	for _, casbinRule := range casbinRules {
-		rule := casbinRule.ToStringSlice()
-		sec := rule[0][0:1]
-		model.AddPolicy(sec, rule[0], rule[1:])
+// LoadIncrementalFilteredPolicy adds the policy rules that match the filter to
+// the policy already loaded, skipping the rules it already has. It takes the
+// same filters as LoadFilteredPolicy. A policy loaded in full stays unfiltered.
+func (a *FilteredAdapter) LoadIncrementalFilteredPolicy(mod casbinModel.Model, filter interface{}) error {
+	return a.LoadIncrementalFilteredPolicyCtx(context.Background(), mod, filter)
+}
+
+// LoadIncrementalFilteredPolicyCtx is LoadIncrementalFilteredPolicy with a context.Context
+func (a *FilteredAdapter) LoadIncrementalFilteredPolicyCtx(ctx context.Context, mod casbinModel.Model, filter interface{}) error {
+	if filter == nil {
+		return a.LoadPolicyCtx(ctx, mod)
 	}
+
+	if err := a.loadFilteredPolicyFile(ctx, mod, filter); err != nil {
+		return err
+	}
+	if !a.loadedAll {
+		a.filtered = true
+		a.filters = append(a.filters, filter)
+	}
+	a.holdsPolicy = hasPolicy(mod)
 	return nil
 }
 
+// Filters returns the filters of the policy loaded, in the order applied. It
+// is empty when the policy has been loaded in full.
+func (a *FilteredAdapter) Filters() []interface{} {
+	filters := make([]interface{}, len(a.filters))
+	copy(filters, a.filters)
+	return filters
+}
+
+func (a *FilteredAdapter) loadFilteredPolicyFile(ctx context.Context, mod casbinModel.Model, filter interface{}) error {
+	var casbinRules []model.CasbinRule
+	var err error
+	switch filterValue := filter.(type) {
+	case *model.Filter:
+		casbinRules, err = a.casbinRuleRepository.LoadFilteredRulesCtx(ctx, filterValue)
+	case *model.ConditionFilter:
+		casbinRules, err = a.casbinRuleRepository.LoadConditionFilteredRulesCtx(ctx, filterValue)
+	case model.PTypeFilter:
+		casbinRules, err = a.casbinRuleRepository.LoadPTypeFilteredRulesCtx(ctx, filterValue)
+	case map[string][]string:
+		casbinRules, err = a.casbinRuleRepository.LoadPTypeFilteredRulesCtx(ctx, model.NewPTypeFilter(filterValue))
+	default:
+		return errors.New("invalid filter type")
+	}
+	if err != nil {
+		return err
+	}
+	return loadCasbinRules(mod, casbinRules)
+}
+
 // IsFiltered returns true if the loaded policy has been filtered.
 func (a *FilteredAdapter) IsFiltered() bool {
 	return a.filtered
 }
 
-// SavePolicy saves all policy rules to the storage.
-func (a *FilteredAdapter) SavePolicy(model casbinModel.Model) error {
-	if a.filtered {
-		return errors.New("cannot save a filtered policy")
+// SavePolicy saves all policy rules to the storage. When the policy loaded is
+// filtered, only the rows matching the filters applied are replaced, in a
+// single transaction. Enforcer.SavePolicy refuses to save a filtered policy,
+// so call the adapter with the model of the enforcer instead.
+func (a *FilteredAdapter) SavePolicy(mod casbinModel.Model) error {
+	return a.SavePolicyCtx(context.Background(), mod)
+}
+
+// SavePolicyCtx is SavePolicy with a context.Context
+func (a *FilteredAdapter) SavePolicyCtx(ctx context.Context, mod casbinModel.Model) error {
+	if !a.filtered {
+		return a.Adapter.SavePolicyCtx(ctx, mod)
+	}
+	filters := make([]interface{}, 0, len(a.filters))
+	for _, filter := range a.filters {
+		if values, ok := filter.(map[string][]string); ok {
+			filter = model.NewPTypeFilter(values)
+		}
+		filters = append(filters, filter)
 	}
-	return a.Adapter.SavePolicy(model)
+	return a.casbinRuleRepository.SyncFilteredCasbinRulesCtx(ctx, filters, casbinRulesFromModel(mod))
 }
@@ -3,6 +3,6 @@ module github.com/cychiuae/casbin-pg-adapter
 go 1.14
 
 require (
-	github.com/casbin/casbin/v2 v2.1.2
+	github.com/casbin/casbin/v2 v2.77.0
 	github.com/lib/pq v1.2.0
 )
@@ -0,0 +1,128 @@
+package casbinpgadapter
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	"github.com/casbin/casbin/v2"
+	casbinModel "github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+)
+
+// IncrementalWatcher is a Watcher which broadcasts the policy rules changed, so
+// that other instances can apply the change without reloading the whole policy.
+// Changes too large for a NOTIFY payload fall back to a full reload.
+type IncrementalWatcher struct {
+	*Watcher
+}
+
+var (
+	_ persist.WatcherEx        = (*IncrementalWatcher)(nil)
+	_ persist.UpdatableWatcher = (*IncrementalWatcher)(nil)
+)
+
+// NewIncrementalWatcher returns a new IncrementalWatcher. See NewWatcher for the
+// meaning of the arguments.
+func NewIncrementalWatcher(db *sql.DB, dataSourceName string, channel string) (*IncrementalWatcher, error) {
+	watcher, err := NewWatcher(db, dataSourceName, channel)
+	if err != nil {
+		return nil, err
+	}
+	return &IncrementalWatcher{watcher}, nil
+}
+
+// UpdateForAddPolicy notifies the other instances that rule has been added.
+func (watcher *IncrementalWatcher) UpdateForAddPolicy(sec, ptype string, params ...string) error {
+	return watcher.UpdateForAddPolicies(sec, ptype, params)
+}
+
+// UpdateForRemovePolicy notifies the other instances that rule has been removed.
+func (watcher *IncrementalWatcher) UpdateForRemovePolicy(sec, ptype string, params ...string) error {
+	return watcher.UpdateForRemovePolicies(sec, ptype, params)
+}
+
+// UpdateForRemoveFilteredPolicy notifies the other instances that the rules
+// matching the filter have been removed.
+func (watcher *IncrementalWatcher) UpdateForRemoveFilteredPolicy(sec, ptype string, fieldIndex int, fieldValues ...string) error {
+	return watcher.publish(watcherMessage{
+		Method:      watcherMethodUpdateForRemoveFilteredPolicy,
+		Sec:         sec,
+		PType:       ptype,
+		FieldIndex:  fieldIndex,
+		FieldValues: fieldValues,
+	})
+}
+
+// UpdateForSavePolicy notifies the other instances to reload the whole policy.
+func (watcher *IncrementalWatcher) UpdateForSavePolicy(model casbinModel.Model) error {
+	return watcher.Update()
+}
+
+// UpdateForAddPolicies notifies the other instances that rules have been added.
+func (watcher *IncrementalWatcher) UpdateForAddPolicies(sec string, ptype string, rules ...[]string) error {
+	return watcher.publish(watcherMessage{
+		Method: watcherMethodUpdateForAddPolicies,
+		Sec:    sec,
+		PType:  ptype,
+		Rules:  rules,
+	})
+}
+
+// UpdateForRemovePolicies notifies the other instances that rules have been removed.
+func (watcher *IncrementalWatcher) UpdateForRemovePolicies(sec string, ptype string, rules ...[]string) error {
+	return watcher.publish(watcherMessage{
+		Method: watcherMethodUpdateForRemovePolicies,
+		Sec:    sec,
+		PType:  ptype,
+		Rules:  rules,
+	})
+}
+
+// UpdateForUpdatePolicy notifies the other instances that oldRule has been
+// replaced by newRule.
+func (watcher *IncrementalWatcher) UpdateForUpdatePolicy(sec string, ptype string, oldRule, newRule []string) error {
+	return watcher.UpdateForUpdatePolicies(sec, ptype, [][]string{oldRule}, [][]string{newRule})
+}
+
+// UpdateForUpdatePolicies notifies the other instances that oldRules have been
+// replaced by newRules.
+func (watcher *IncrementalWatcher) UpdateForUpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	return watcher.publish(watcherMessage{
+		Method:   watcherMethodUpdateForUpdatePolicies,
+		Sec:      sec,
+		PType:    ptype,
+		OldRules: oldRules,
+		Rules:    newRules,
+	})
+}
+
+// NewIncrementalUpdateCallback returns an update callback for an
+// IncrementalWatcher which applies the changes of other instances to enforcer
+// in memory, and reloads the whole policy when no change is given.
+func NewIncrementalUpdateCallback(enforcer casbin.IDistributedEnforcer) func(string) {
+	shouldPersist := func() bool { return false }
+	return func(payload string) {
+		var message watcherMessage
+		if err := json.Unmarshal([]byte(payload), &message); err != nil {
+			message.Method = watcherMethodUpdate
+		}
+
+		var err error
+		switch message.Method {
+		case watcherMethodUpdateForAddPolicies:
+			_, err = enforcer.AddPoliciesSelf(shouldPersist, message.Sec, message.PType, message.Rules)
+		case watcherMethodUpdateForRemovePolicies:
+			_, err = enforcer.RemovePoliciesSelf(shouldPersist, message.Sec, message.PType, message.Rules)
+		case watcherMethodUpdateForRemoveFilteredPolicy:
+			_, err = enforcer.RemoveFilteredPolicySelf(shouldPersist, message.Sec, message.PType, message.FieldIndex, message.FieldValues...)
+		case watcherMethodUpdateForUpdatePolicies:
+			_, err = enforcer.UpdatePoliciesSelf(shouldPersist, message.Sec, message.PType, message.OldRules, message.Rules)
+		default:
+			err = enforcer.LoadPolicy()
+		}
+		if err != nil {
+			log.Printf("Cannot apply watcher message %v. Error: %v", message.Method, err)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package casbinpgadapter
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/cychiuae/casbin-pg-adapter/pkg/model"
+)
+
+const (
+	defaultDBSchema      = "public"
+	defaultTableName     = "casbin_rule"
+	defaultColumnWidth   = 256
+	defaultCopyBatchSize = 10000
+	defaultFieldCount    = model.DefaultFieldCount
+)
+
+// settingPattern matches the names of custom settings, such as app.tenant
+var settingPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*\.[a-z_][a-z0-9_]*$`)
+
+// SavePolicyMode selects how SavePolicy writes the policy to the casbin table
+type SavePolicyMode int
+
+const (
+	// SavePolicyModeDiff deletes and inserts only the rules which differ from
+	// the stored ones. Readers of the table are not blocked.
+	SavePolicyModeDiff SavePolicyMode = iota
+	// SavePolicyModeTruncate truncates the table and inserts every rule again.
+	// The table is locked for readers and writers until it completes.
+	SavePolicyModeTruncate
+	// SavePolicyModeCopy truncates the table like SavePolicyModeTruncate, but
+	// streams the rules with the COPY protocol. It suits initial imports of
+	// large policies.
+	SavePolicyModeCopy
+)
+
+// Logger is the interface the adapter logs with. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdLogger logs with the standard logger of package log
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// Option configures an Adapter
+type Option func(*options)
+
+type options struct {
+	dbSchema       string
+	tableName      string
+	columnWidth    int
+	fieldCount     int
+	indexes        []string
+	logger         Logger
+	autoMigrate    bool
+	savePolicyMode SavePolicyMode
+	copyBatchSize  int
+	tenantColumn   bool
+	// rowLevelSecuritySetting is the session variable of the row level
+	// security policy, or empty when row level security is disabled
+	rowLevelSecuritySetting string
+	auditLog                bool
+	// auditKey is the key of the HMAC chaining the audit entries, if any
+	auditKey []byte
+	temporal bool
+}
+
+// auditTableName returns the name of the audit table, or an empty string when
+// the audit log is disabled
+func (o options) auditTableName() string {
+	if !o.auditLog {
+		return ""
+	}
+	return o.tableName + "_audit"
+}
+
+func newOptions(opts ...Option) (options, error) {
+	o := options{
+		dbSchema:       defaultDBSchema,
+		tableName:      defaultTableName,
+		columnWidth:    defaultColumnWidth,
+		fieldCount:     defaultFieldCount,
+		logger:         stdLogger{},
+		autoMigrate:    true,
+		savePolicyMode: SavePolicyModeDiff,
+		copyBatchSize:  defaultCopyBatchSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	// Every column is indexed unless WithIndexes says otherwise.
+	if o.indexes == nil {
+		o.indexes = o.columns()
+	}
+	if err := o.validate(); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+func (o options) validate() error {
+	if o.dbSchema == "" {
+		return fmt.Errorf("db schema must not be empty")
+	}
+	if o.tableName == "" {
+		return fmt.Errorf("table name must not be empty")
+	}
+	if o.columnWidth <= 0 {
+		return fmt.Errorf("column width must be positive but got %d", o.columnWidth)
+	}
+	if o.fieldCount < defaultFieldCount {
+		return fmt.Errorf("field count must be at least %d but got %d", defaultFieldCount, o.fieldCount)
+	}
+	for _, index := range o.indexes {
+		known := false
+		for _, column := range o.columns() {
+			if index == column {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("cannot index unknown column %s", index)
+		}
+	}
+	if o.logger == nil {
+		return fmt.Errorf("logger must not be nil")
+	}
+	switch o.savePolicyMode {
+	case SavePolicyModeDiff, SavePolicyModeTruncate, SavePolicyModeCopy:
+	default:
+		return fmt.Errorf("unknown save policy mode %d", o.savePolicyMode)
+	}
+	if o.copyBatchSize <= 0 {
+		return fmt.Errorf("copy batch size must be positive but got %d", o.copyBatchSize)
+	}
+	if o.rowLevelSecuritySetting != "" {
+		if !o.tenantColumn {
+			return fmt.Errorf("row level security requires the tenant column")
+		}
+		if !settingPattern.MatchString(o.rowLevelSecuritySetting) {
+			return fmt.Errorf("row level security setting %q must be a custom setting such as app.tenant", o.rowLevelSecuritySetting)
+		}
+		if o.savePolicyMode == SavePolicyModeCopy {
+			return fmt.Errorf("row level security does not support COPY, which SavePolicyModeCopy uses")
+		}
+	}
+	if len(o.auditKey) > 0 && !o.auditLog {
+		return fmt.Errorf("audit key requires the audit log")
+	}
+	return nil
+}
+
+// columns returns the columns of the casbin table
+func (o options) columns() []string {
+	columns := make([]string, 0, o.fieldCount+1)
+	columns = append(columns, "p_type")
+	for i := 0; i < o.fieldCount; i++ {
+		columns = append(columns, fmt.Sprintf("v%d", i))
+	}
+	return columns
+}
+
+// WithDBSchema sets the schema of the casbin table. It defaults to public.
+func WithDBSchema(dbSchema string) Option {
+	return func(o *options) {
+		o.dbSchema = dbSchema
+	}
+}
+
+// WithTableName sets the name of the casbin table. It defaults to casbin_rule.
+func WithTableName(tableName string) Option {
+	return func(o *options) {
+		o.tableName = tableName
+	}
+}
+
+// WithColumnWidth sets the maximum length of the values stored in the casbin
+// table. It only applies when the table is created and defaults to 256.
+func WithColumnWidth(columnWidth int) Option {
+	return func(o *options) {
+		o.columnWidth = columnWidth
+	}
+}
+
+// WithFieldCount sets the number of value columns of the casbin table, v0 to
+// v<fieldCount-1>, for policies with more fields than v0 to v5. Migrating adds
+// the columns the table lacks. It defaults to 6.
+func WithFieldCount(fieldCount int) Option {
+	return func(o *options) {
+		o.fieldCount = fieldCount
+	}
+}
+
+// WithIndexes sets the columns of the casbin table which are indexed. It only
+// applies when the columns are created and defaults to every column.
+func WithIndexes(columns ...string) Option {
+	return func(o *options) {
+		o.indexes = append([]string{}, columns...)
+	}
+}
+
+// WithLogger sets the logger of the adapter. It defaults to the standard logger.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithAutoMigrate sets whether the adapter applies the pending schema migrations
+// when it is created. When disabled, the adapter only checks that the casbin
+// table exists with the expected columns, so a role with DML rights only is
+// enough. It is enabled by default.
+func WithAutoMigrate(autoMigrate bool) Option {
+	return func(o *options) {
+		o.autoMigrate = autoMigrate
+	}
+}
+
+// WithSavePolicyMode sets how SavePolicy writes the policy. It defaults to
+// SavePolicyModeDiff.
+func WithSavePolicyMode(savePolicyMode SavePolicyMode) Option {
+	return func(o *options) {
+		o.savePolicyMode = savePolicyMode
+	}
+}
+
+// WithCopyBatchSize sets the number of rules sent per COPY statement by
+// SavePolicyModeCopy and BulkInsertCasbinRules. It defaults to 10000.
+func WithCopyBatchSize(copyBatchSize int) Option {
+	return func(o *options) {
+		o.copyBatchSize = copyBatchSize
+	}
+}
+
+// WithTenantColumn sets whether the casbin table has a tenant_id column, which
+// migrating adds along with its index. The adapter then only applies to the
+// rules of the empty tenant, and Adapter.ForTenant returns views of the other
+// tenants. It is disabled by default.
+func WithTenantColumn(tenantColumn bool) Option {
+	return func(o *options) {
+		o.tenantColumn = tenantColumn
+	}
+}
+
+// WithRowLevelSecurity enables row level security on the casbin table when it
+// is migrated, with a policy letting a session only reach the rules whose
+// tenant equals the session variable setting, such as app.tenant. The adapter
+// sets the variable to its tenant with SET LOCAL in each transaction. It
+// requires WithTenantColumn and is disabled by default.
+func WithRowLevelSecurity(setting string) Option {
+	return func(o *options) {
+		o.rowLevelSecuritySetting = setting
+	}
+}
+
+// WithAuditLog sets whether each rule inserted or deleted is recorded in the
+// audit table, named after the casbin table with an _audit suffix, in the
+// transaction of the change. Migrating creates the audit table. It is disabled
+// by default.
+func WithAuditLog(auditLog bool) Option {
+	return func(o *options) {
+		o.auditLog = auditLog
+	}
+}
+
+// WithAuditKey sets the key of the HMAC-SHA256 chaining the audit entries in
+// place of a plain SHA-256, so that whoever can edit the audit table cannot
+// recompute the chain without it. Keep it outside the database. It requires
+// WithAuditLog, and the entries recorded with one key do not verify with
+// another.
+func WithAuditKey(auditKey []byte) Option {
+	return func(o *options) {
+		o.auditKey = auditKey
+	}
+}
+
+// WithTemporal sets whether the casbin table keeps the rules removed, closed
+// out by their valid_to column, so that Adapter.LoadPolicyAsOf can load the
+// policy of any past instant. Migrating adds the valid_from and valid_to
+// columns. It is disabled by default.
+func WithTemporal(temporal bool) Option {
+	return func(o *options) {
+		o.temporal = temporal
+	}
+}
@@ -0,0 +1,98 @@
+package casbinpgadapter
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+func TestNewOptions(t *testing.T) {
+	o, err := newOptions()
+	if err != nil {
+		t.Fatalf("Cannot create default options %v", err)
+	}
+	if o.dbSchema != "public" || o.tableName != "casbin_rule" || o.columnWidth != 256 || len(o.indexes) != 7 || !o.autoMigrate || o.savePolicyMode != SavePolicyModeDiff || o.tenantColumn {
+		t.Errorf("Unexpected default options %+v", o)
+	}
+
+	logger := log.New(os.Stderr, "casbin ", log.LstdFlags)
+	o, err = newOptions(
+		WithDBSchema("auth"),
+		WithTableName("rules"),
+		WithColumnWidth(64),
+		WithFieldCount(8),
+		WithIndexes("p_type", "v0", "v7"),
+		WithLogger(logger),
+		WithAutoMigrate(false),
+		WithTenantColumn(true),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create options %v", err)
+	}
+	if o.dbSchema != "auth" || o.tableName != "rules" || o.columnWidth != 64 || o.fieldCount != 8 || len(o.indexes) != 3 || o.logger != logger || o.autoMigrate || !o.tenantColumn {
+		t.Errorf("Unexpected options %+v", o)
+	}
+
+	o, err = newOptions(WithFieldCount(8))
+	if err != nil {
+		t.Fatalf("Cannot create options %v", err)
+	}
+	if len(o.indexes) != 9 || o.indexes[8] != "v7" {
+		t.Errorf("Unexpected default indexes %v", o.indexes)
+	}
+
+	o, err = newOptions(WithIndexes())
+	if err != nil {
+		t.Fatalf("Cannot create options %v", err)
+	}
+	if len(o.indexes) != 0 {
+		t.Errorf("Unexpected indexes %v", o.indexes)
+	}
+
+	o, err = newOptions(WithTenantColumn(true), WithRowLevelSecurity("app.tenant"))
+	if err != nil {
+		t.Fatalf("Cannot create options %v", err)
+	}
+	if o.rowLevelSecuritySetting != "app.tenant" {
+		t.Errorf("Unexpected row level security setting %v", o.rowLevelSecuritySetting)
+	}
+
+	o, err = newOptions(WithTableName("rules"), WithAuditLog(true))
+	if err != nil {
+		t.Fatalf("Cannot create options %v", err)
+	}
+	if o.auditTableName() != "rules_audit" {
+		t.Errorf("Unexpected audit table %v", o.auditTableName())
+	}
+	if o, _ = newOptions(WithAuditLog(true), WithAuditKey([]byte("secret"))); string(o.auditKey) != "secret" {
+		t.Errorf("Unexpected audit key %v", o.auditKey)
+	}
+	if o, _ = newOptions(); o.auditTableName() != "" {
+		t.Errorf("Unexpected audit table %v", o.auditTableName())
+	}
+
+	if o, _ = newOptions(WithTemporal(true)); !o.temporal {
+		t.Errorf("Expected temporal options")
+	}
+
+	invalidOptions := [][]Option{
+		{WithDBSchema("")},
+		{WithTableName("")},
+		{WithColumnWidth(0)},
+		{WithFieldCount(5)},
+		{WithIndexes("p_type", "v9")},
+		{WithLogger(nil)},
+		{WithSavePolicyMode(SavePolicyMode(-1))},
+		{WithCopyBatchSize(0)},
+		{WithRowLevelSecurity("app.tenant")},
+		{WithTenantColumn(true), WithRowLevelSecurity("tenant")},
+		{WithTenantColumn(true), WithRowLevelSecurity("app.tenant'; --")},
+		{WithTenantColumn(true), WithRowLevelSecurity("app.tenant"), WithSavePolicyMode(SavePolicyModeCopy)},
+		{WithAuditKey([]byte("secret"))},
+	}
+	for _, opts := range invalidOptions {
+		if _, err = newOptions(opts...); err == nil {
+			t.Errorf("Expected error for invalid options")
+		}
+	}
+}
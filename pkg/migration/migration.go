@@ -0,0 +1,783 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Table describes the casbin table a migration is applied to
+type Table struct {
+	Schema string
+	Name   string
+	// ColumnWidth is the maximum length of the values stored in the table
+	ColumnWidth int
+	// FieldCount is the number of value columns of the table, v0 to
+	// v<FieldCount-1>. It is at least 6.
+	FieldCount int
+	// Indexes are the columns indexed when they are created
+	Indexes []string
+	// TenantColumn is whether the table has a tenant_id column
+	TenantColumn bool
+	// RowLevelSecuritySetting is the session variable the row level security
+	// policy of the table compares tenant_id to. Row level security is left
+	// disabled when it is empty.
+	RowLevelSecuritySetting string
+	// AuditTable is the name of the table recording the changes of the casbin
+	// rules, in the schema of the table. No audit table is created when it is
+	// empty.
+	AuditTable string
+	// Temporal is whether the table has the valid_from and valid_to columns,
+	// bounding the time each row was current, and the row_id column ordering
+	// the rows inserted at the same time
+	Temporal bool
+}
+
+// columns returns the columns of the table the adapter relies on
+func (table Table) columns() []string {
+	columns := make([]string, 0, table.FieldCount+1)
+	columns = append(columns, "p_type")
+	for i := 0; i < table.FieldCount; i++ {
+		columns = append(columns, fmt.Sprintf("v%d", i))
+	}
+	if table.TenantColumn {
+		columns = append(columns, "tenant_id")
+	}
+	if table.Temporal {
+		columns = append(columns, "valid_from", "valid_to", "row_id")
+	}
+	return columns
+}
+
+// indexed reports whether column is one of the indexed columns of the table
+func (table Table) indexed(column string) bool {
+	for _, index := range table.Indexes {
+		if index == column {
+			return true
+		}
+	}
+	return false
+}
+
+// Logger is the interface migrations log with
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Migration is a versioned change of the casbin table
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, tx *sql.Tx, table Table) error
+}
+
+// casbinRuleColumns are the columns of the casbin table created by the first
+// migration
+var casbinRuleColumns = []string{
+	"p_type",
+	"v0",
+	"v1",
+	"v2",
+	"v3",
+	"v4",
+	"v5",
+}
+
+// Migrations are the migrations of the casbin table, ordered by version
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create casbin rule table",
+		Up:          createCasbinRuleTable,
+	},
+	{
+		Version:     2,
+		Description: "make value columns nullable",
+		Up:          makeValueColumnsNullable,
+	},
+	{
+		Version:     3,
+		Description: "chain audit entries",
+		Up:          chainAuditTable,
+	},
+}
+
+// Migrate applies the migrations not yet applied to table, in order and in a
+// single transaction, then the steps of the options of table not yet applied:
+// adding the value columns beyond v5, the tenant column and the temporal
+// columns, creating the audit table and setting up row level security.
+// An advisory lock on table serialises concurrent callers, so instances
+// starting at the same time do not race each other.
+func Migrate(ctx context.Context, db *sql.DB, table Table, migrations []Migration, logger Logger) error {
+	if err := validate(migrations); err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Printf("Cannot start transaction")
+		return err
+	}
+	if err = migrate(ctx, tx, table, migrations, logger); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.Printf("Cannot commit transaction %v", err)
+		_ = tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// migrate applies migrations under an advisory lock, then the option steps of
+// table. Each option step is recorded along with the value of its option in the
+// <table>_migration_options table, and is only applied again once the value
+// changes. The steps check the catalog before altering anything, so that they
+// also apply to the tables set up before they were recorded, without taking the
+// exclusive lock of ALTER TABLE for what is already there.
+func migrate(ctx context.Context, tx *sql.Tx, table Table, migrations []Migration, logger Logger) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`SELECT pg_advisory_xact_lock(hashtext($1))`,
+		fmt.Sprintf("casbin-pg-adapter:%s.%s", table.Schema, table.Name),
+	)
+	if err != nil {
+		logger.Printf("Cannot acquire migration lock %v", err)
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS "%s"."%s_migrations" (
+			version     integer primary key,
+			description text not null default '',
+			applied_at  timestamptz not null default now()
+		)
+	`, table.Schema, table.Name))
+	if err != nil {
+		logger.Printf("Cannot create migrations table %v", err)
+		return err
+	}
+	var currentVersion int
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT COALESCE(MAX(version), 0) FROM "%s"."%s_migrations"
+	`, table.Schema, table.Name)).Scan(&currentVersion)
+	if err != nil {
+		logger.Printf("Cannot read migration version %v", err)
+		return err
+	}
+	for _, migration := range migrations {
+		if migration.Version <= currentVersion {
+			continue
+		}
+		if err = migration.Up(ctx, tx, table); err != nil {
+			logger.Printf("Cannot apply migration %v. Error: %v", migration.Version, err)
+			return err
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			fmt.Sprintf(`
+				INSERT INTO "%s"."%s_migrations" (version, description)
+				VALUES ($1, $2)
+			`, table.Schema, table.Name),
+			migration.Version,
+			migration.Description,
+		)
+		if err != nil {
+			logger.Printf("Cannot record migration %v. Error: %v", migration.Version, err)
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS "%s"."%s_migration_options" (
+			name       text primary key,
+			value      text not null,
+			applied_at timestamptz not null default now()
+		)
+	`, table.Schema, table.Name))
+	if err != nil {
+		logger.Printf("Cannot create migration options table %v", err)
+		return err
+	}
+	for _, step := range table.optionSteps() {
+		if err = applyOptionStep(ctx, tx, table, step); err != nil {
+			logger.Printf("Cannot %s %v", step.description, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// optionStep is a change of the schema which depends on an option of the
+// table rather than on a version
+type optionStep struct {
+	// option is the name the step is recorded under
+	option string
+	// value is the value of the option the step applies
+	value       string
+	description string
+	apply       func(ctx context.Context, tx *sql.Tx, table Table) error
+}
+
+// optionSteps returns the steps of the options of table, in order
+func (table Table) optionSteps() []optionStep {
+	steps := []optionStep{
+		{"field_count", strconv.Itoa(table.FieldCount), "add value columns", addValueColumns},
+	}
+	if table.TenantColumn {
+		steps = append(steps, optionStep{"tenant_column", "true", "add tenant column", addTenantColumn})
+	}
+	if table.Temporal {
+		steps = append(steps, optionStep{"temporal", "true", "add temporal columns", addTemporalColumns})
+	}
+	if table.AuditTable != "" {
+		steps = append(steps, optionStep{"audit_table", table.AuditTable, "create audit table", createAuditTable})
+	}
+	if table.RowLevelSecuritySetting != "" {
+		names := []string{table.Name}
+		if table.AuditTable != "" {
+			names = append(names, table.AuditTable)
+		}
+		for _, name := range names {
+			name := name
+			steps = append(steps, optionStep{
+				"row_level_security:" + name,
+				table.RowLevelSecuritySetting,
+				fmt.Sprintf("enable row level security on %s", name),
+				func(ctx context.Context, tx *sql.Tx, table Table) error {
+					return enableRowLevelSecurity(ctx, tx, table, name)
+				},
+			})
+		}
+	}
+	return steps
+}
+
+// applyOptionStep applies step to table and records it, unless it has been
+// recorded with the same value
+func applyOptionStep(ctx context.Context, tx *sql.Tx, table Table, step optionStep) error {
+	var applied bool
+	err := tx.QueryRowContext(
+		ctx,
+		fmt.Sprintf(`
+			SELECT EXISTS (
+				SELECT 1 FROM "%s"."%s_migration_options"
+				WHERE name = $1 AND value = $2
+			)
+		`, table.Schema, table.Name),
+		step.option,
+		step.value,
+	).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+	if err = step.apply(ctx, tx, table); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		fmt.Sprintf(`
+			INSERT INTO "%s"."%s_migration_options" (name, value)
+			VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value, applied_at = now()
+		`, table.Schema, table.Name),
+		step.option,
+		step.value,
+	)
+	return err
+}
+
+// Verify checks that table exists with the columns the adapter relies on,
+// without changing the database
+func Verify(ctx context.Context, db *sql.DB, table Table) error {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT column_name, is_nullable = 'YES' FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2`,
+		table.Schema,
+		table.Name,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	// columns maps the column names of the table to whether they are nullable
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var column string
+		var nullable bool
+		if err = rows.Scan(&column, &nullable); err != nil {
+			return err
+		}
+		columns[column] = nullable
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf(
+			`table "%s"."%s" does not exist or is not accessible, migrate it with a role allowed to create it`,
+			table.Schema,
+			table.Name,
+		)
+	}
+	missingColumns := make([]string, 0)
+	notNullColumns := make([]string, 0)
+	for i, column := range table.columns() {
+		nullable, ok := columns[column]
+		if !ok {
+			missingColumns = append(missingColumns, column)
+		} else if i > 0 && i <= table.FieldCount && !nullable {
+			notNullColumns = append(notNullColumns, column)
+		}
+	}
+	if len(missingColumns) > 0 {
+		return fmt.Errorf(
+			`table "%s"."%s" is missing columns %s, migrate it with a role allowed to alter it`,
+			table.Schema,
+			table.Name,
+			strings.Join(missingColumns, ", "),
+		)
+	}
+	if len(notNullColumns) > 0 {
+		return fmt.Errorf(
+			`columns %s of table "%s"."%s" are not nullable, migrate it with a role allowed to alter it`,
+			strings.Join(notNullColumns, ", "),
+			table.Schema,
+			table.Name,
+		)
+	}
+	if table.AuditTable != "" {
+		var hashColumn sql.NullBool
+		err = db.QueryRowContext(
+			ctx,
+			`
+				SELECT bool_or(column_name = 'hash') FROM information_schema.columns
+				WHERE table_schema = $1 AND table_name = $2
+			`,
+			table.Schema,
+			table.AuditTable,
+		).Scan(&hashColumn)
+		if err != nil {
+			return err
+		}
+		if !hashColumn.Valid {
+			return fmt.Errorf(
+				`audit table "%s"."%s" does not exist or is not accessible, migrate it with a role allowed to create it`,
+				table.Schema,
+				table.AuditTable,
+			)
+		}
+		if !hashColumn.Bool {
+			return fmt.Errorf(
+				`audit table "%s"."%s" is missing column hash, migrate it with a role allowed to alter it`,
+				table.Schema,
+				table.AuditTable,
+			)
+		}
+		var chainTable bool
+		err = db.QueryRowContext(
+			ctx,
+			`SELECT to_regclass(format('%I.%I', $1::text, $2::text)) IS NOT NULL`,
+			table.Schema,
+			table.AuditTable+"_chain",
+		).Scan(&chainTable)
+		if err != nil {
+			return err
+		}
+		if !chainTable {
+			return fmt.Errorf(
+				`audit chain table "%s"."%s_chain" does not exist or is not accessible, migrate it with a role allowed to create it`,
+				table.Schema,
+				table.AuditTable,
+			)
+		}
+	}
+	if table.RowLevelSecuritySetting != "" {
+		var rowLevelSecurity bool
+		err = db.QueryRowContext(
+			ctx,
+			`
+				SELECT relrowsecurity FROM pg_class
+				WHERE oid = to_regclass(format('%I.%I', $1::text, $2::text))
+			`,
+			table.Schema,
+			table.Name,
+		).Scan(&rowLevelSecurity)
+		if err != nil {
+			return err
+		}
+		if !rowLevelSecurity {
+			return fmt.Errorf(
+				`table "%s"."%s" has no row level security, migrate it with a role allowed to alter it`,
+				table.Schema,
+				table.Name,
+			)
+		}
+	}
+	return nil
+}
+
+func validate(migrations []Migration) error {
+	previousVersion := 0
+	for _, migration := range migrations {
+		if migration.Version <= previousVersion {
+			return fmt.Errorf("migration version %d must be greater than %d", migration.Version, previousVersion)
+		}
+		previousVersion = migration.Version
+	}
+	return nil
+}
+
+func createCasbinRuleTable(ctx context.Context, tx *sql.Tx, table Table) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS "%s"."%s" (
+			p_type varchar(%[3]d) not null default '',
+			v0 		varchar(%[3]d) not null default '',
+			v1 		varchar(%[3]d) not null default '',
+			v2 		varchar(%[3]d) not null default '',
+			v3 		varchar(%[3]d) not null default '',
+			v4 		varchar(%[3]d) not null default '',
+			v5 		varchar(%[3]d) not null default ''
+		)
+	`, table.Schema, table.Name, table.ColumnWidth))
+	if err != nil {
+		return err
+	}
+	for _, column := range casbinRuleColumns {
+		if !table.indexed(column) {
+			continue
+		}
+		if err = createIndex(ctx, tx, table, column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addValueColumns adds the value columns beyond v5 which table lacks, along
+// with their indexes. Their number depends on the configuration of the adapter
+// rather than on a version, so they are not a versioned migration.
+func addValueColumns(ctx context.Context, tx *sql.Tx, table Table) error {
+	for i := len(casbinRuleColumns) - 1; i < table.FieldCount; i++ {
+		column := fmt.Sprintf("v%d", i)
+		exists, err := columnExists(ctx, tx, table.Schema, table.Name, column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+			ALTER TABLE "%s"."%s" ADD COLUMN %s varchar(%d)
+		`, table.Schema, table.Name, column, table.ColumnWidth))
+		if err != nil {
+			return err
+		}
+		if !table.indexed(column) {
+			continue
+		}
+		if err = createIndex(ctx, tx, table, column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeValueColumnsNullable lets the value columns hold NULL for the fields a
+// rule lacks, so that they are told apart from empty fields. The trailing empty
+// values of the existing rows are taken for lacking fields.
+func makeValueColumnsNullable(ctx context.Context, tx *sql.Tx, table Table) error {
+	rows, err := tx.QueryContext(
+		ctx,
+		`
+			SELECT column_name FROM information_schema.columns
+			WHERE table_schema = $1 AND table_name = $2 AND column_name ~ '^v[0-9]+$'
+			ORDER BY substring(column_name FROM 2)::integer DESC
+		`,
+		table.Schema,
+		table.Name,
+	)
+	if err != nil {
+		return err
+	}
+	columns := make([]string, 0)
+	for rows.Next() {
+		var column string
+		if err = rows.Scan(&column); err != nil {
+			rows.Close()
+			return err
+		}
+		columns = append(columns, column)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	// columns are ordered from the last one, so each is only cleared when the
+	// columns after it have been.
+	for i, column := range columns {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+			ALTER TABLE "%s"."%s" ALTER COLUMN %s DROP NOT NULL, ALTER COLUMN %[3]s DROP DEFAULT
+		`, table.Schema, table.Name, column))
+		if err != nil {
+			return err
+		}
+		condition := fmt.Sprintf("%s = ''", column)
+		if i > 0 {
+			condition = fmt.Sprintf("%s AND %s IS NULL", condition, columns[i-1])
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+			UPDATE "%s"."%s" SET %s = NULL WHERE %s
+		`, table.Schema, table.Name, column, condition))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTenantColumn adds the tenant_id column, which holds the tenant of each
+// rule, along with an index leading with it since every statement is scoped to
+// a tenant. The rows already there belong to the empty tenant.
+func addTenantColumn(ctx context.Context, tx *sql.Tx, table Table) error {
+	exists, err := columnExists(ctx, tx, table.Schema, table.Name, "tenant_id")
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		ALTER TABLE "%s"."%s" ADD COLUMN tenant_id varchar(%d) not null default ''
+	`, table.Schema, table.Name, table.ColumnWidth))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		CREATE INDEX IF NOT EXISTS idx_%[2]s_tenant_id ON "%[1]s"."%[2]s" (tenant_id, p_type)
+	`, table.Schema, table.Name))
+	return err
+}
+
+// addTemporalColumns adds the valid_from and valid_to columns, which bound the
+// time each row was current, along with an index for loading the rows of an
+// instant, and the row_id column, which orders the rows inserted at the same
+// time. A row is current while its valid_to is NULL. The rows already there
+// are taken to have always been current.
+func addTemporalColumns(ctx context.Context, tx *sql.Tx, table Table) error {
+	columnStatements := []struct {
+		column     string
+		statements []string
+	}{
+		{"valid_from", []string{
+			`ALTER TABLE "%[1]s"."%[2]s" ADD COLUMN valid_from timestamptz not null default '-infinity'`,
+			`ALTER TABLE "%[1]s"."%[2]s" ALTER COLUMN valid_from SET DEFAULT now()`,
+		}},
+		{"valid_to", []string{
+			`ALTER TABLE "%[1]s"."%[2]s" ADD COLUMN valid_to timestamptz`,
+			`CREATE INDEX IF NOT EXISTS idx_%[2]s_valid_to ON "%[1]s"."%[2]s" (valid_to, valid_from)`,
+		}},
+		{"row_id", []string{
+			`ALTER TABLE "%[1]s"."%[2]s" ADD COLUMN row_id bigserial`,
+		}},
+	}
+	for _, columnStatement := range columnStatements {
+		exists, err := columnExists(ctx, tx, table.Schema, table.Name, columnStatement.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		for _, statement := range columnStatement.statements {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf(statement, table.Schema, table.Name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createAuditTable creates the audit table, which holds a row per casbin rule
+// inserted or deleted, chained by their hash, along with an index for paging
+// through the changes of a tenant
+func createAuditTable(ctx context.Context, tx *sql.Tx, table Table) error {
+	exists, err := tableExists(ctx, tx, table.Schema, table.AuditTable)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+			CREATE TABLE "%s"."%s" (
+				id          bigserial primary key,
+				operation   varchar(16) not null,
+				p_type      varchar(%[3]d) not null,
+				rule_values text[] not null,
+				tenant_id   varchar(%[3]d) not null default '',
+				actor       text not null default '',
+				created_at  timestamptz not null default now(),
+				hash        varchar(64)
+			)
+		`, table.Schema, table.AuditTable, table.ColumnWidth))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+			CREATE INDEX idx_%[2]s_tenant_id ON "%[1]s"."%[2]s" (tenant_id, id)
+		`, table.Schema, table.AuditTable))
+		if err != nil {
+			return err
+		}
+	}
+	return addAuditChain(ctx, tx, table)
+}
+
+// chainAuditTable chains the entries of the audit table of table, if it has
+// one already, which the audit tables created before have not been
+func chainAuditTable(ctx context.Context, tx *sql.Tx, table Table) error {
+	if table.AuditTable == "" {
+		return nil
+	}
+	exists, err := tableExists(ctx, tx, table.Schema, table.AuditTable)
+	if err != nil || !exists {
+		return err
+	}
+	return addAuditChain(ctx, tx, table)
+}
+
+// addAuditChain adds the hash column, chaining the entries of each tenant, to
+// the audit table lacking it, whose entries are left without a hash. The chain
+// table then records where the chain starts, outside the rows it protects, so
+// that no entry after the start can pass for one without a hash.
+func addAuditChain(ctx context.Context, tx *sql.Tx, table Table) error {
+	exists, err := columnExists(ctx, tx, table.Schema, table.AuditTable, "hash")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+			ALTER TABLE "%s"."%s" ADD COLUMN hash varchar(64)
+		`, table.Schema, table.AuditTable))
+		if err != nil {
+			return err
+		}
+	}
+	exists, err = tableExists(ctx, tx, table.Schema, table.AuditTable+"_chain")
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE "%s"."%s_chain" (
+			start_id   bigint not null,
+			created_at timestamptz not null default now()
+		)
+	`, table.Schema, table.AuditTable))
+	if err != nil {
+		return err
+	}
+	// The chain starts after the last id handed out, which the sequence knows
+	// regardless of the row level security of the audit table.
+	_, err = tx.ExecContext(
+		ctx,
+		fmt.Sprintf(`
+			INSERT INTO "%s"."%s_chain" (start_id)
+			SELECT COALESCE(pg_sequence_last_value(pg_get_serial_sequence(format('%%I.%%I', $1::text, $2::text), 'id')::regclass), 0)
+		`, table.Schema, table.AuditTable),
+		table.Schema,
+		table.AuditTable,
+	)
+	return err
+}
+
+// enableRowLevelSecurity enables row level security on the table name in the
+// schema of table, with a policy letting through only the rows whose tenant_id
+// equals the session variable table.RowLevelSecuritySetting. It is forced so
+// that the owner of the table is bound by it too. A session without the
+// variable sees no rows. Only what differs from the catalog is changed.
+func enableRowLevelSecurity(ctx context.Context, tx *sql.Tx, table Table, name string) error {
+	policyName := name + "_tenant_isolation"
+	var rowLevelSecurity, forceRowLevelSecurity bool
+	var qual, withCheck sql.NullString
+	err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT c.relrowsecurity, c.relforcerowsecurity, p.qual, p.with_check
+			FROM pg_class c
+			LEFT JOIN pg_policies p ON p.schemaname = $1 AND p.tablename = $2 AND p.policyname = $3
+			WHERE c.oid = to_regclass(format('%I.%I', $1::text, $2::text))
+		`,
+		table.Schema,
+		name,
+		policyName,
+	).Scan(&rowLevelSecurity, &forceRowLevelSecurity, &qual, &withCheck)
+	if err != nil {
+		return err
+	}
+	statements := make([]string, 0, 4)
+	if !rowLevelSecurity {
+		statements = append(statements, `ALTER TABLE "%[1]s"."%[2]s" ENABLE ROW LEVEL SECURITY`)
+	}
+	if !forceRowLevelSecurity {
+		statements = append(statements, `ALTER TABLE "%[1]s"."%[2]s" FORCE ROW LEVEL SECURITY`)
+	}
+	if !isTenantIsolation(qual, table.RowLevelSecuritySetting) || !isTenantIsolation(withCheck, table.RowLevelSecuritySetting) {
+		statements = append(
+			statements,
+			`DROP POLICY IF EXISTS %[3]s ON "%[1]s"."%[2]s"`,
+			`
+				CREATE POLICY %[3]s ON "%[1]s"."%[2]s"
+				USING (tenant_id = current_setting('%[4]s', true))
+				WITH CHECK (tenant_id = current_setting('%[4]s', true))
+			`,
+		)
+	}
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(statement, table.Schema, name, policyName, table.RowLevelSecuritySetting))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isTenantIsolation reports whether expression, as deparsed in pg_policies, is
+// the condition of the tenant isolation policy on setting
+func isTenantIsolation(expression sql.NullString, setting string) bool {
+	return expression.Valid &&
+		expression.String == fmt.Sprintf("((tenant_id)::text = current_setting('%s'::text, true))", setting)
+}
+
+// tableExists reports whether the table name exists in schema
+func tableExists(ctx context.Context, tx *sql.Tx, schema string, name string) (bool, error) {
+	var exists bool
+	err := tx.QueryRowContext(
+		ctx,
+		`SELECT to_regclass(format('%I.%I', $1::text, $2::text)) IS NOT NULL`,
+		schema,
+		name,
+	).Scan(&exists)
+	return exists, err
+}
+
+// columnExists reports whether the table name in schema has column
+func columnExists(ctx context.Context, tx *sql.Tx, schema string, name string, column string) (bool, error) {
+	var exists bool
+	err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_schema = $1 AND table_name = $2 AND column_name = $3
+			)
+		`,
+		schema,
+		name,
+		column,
+	).Scan(&exists)
+	return exists, err
+}
+
+func createIndex(ctx context.Context, tx *sql.Tx, table Table, column string) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		CREATE INDEX IF NOT EXISTS idx_%[2]s_%[3]s ON "%[1]s"."%[2]s" (%[3]s)
+	`, table.Schema, table.Name, column))
+	return err
+}
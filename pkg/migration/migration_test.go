@@ -0,0 +1,49 @@
+package migration
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	if err := validate(Migrations); err != nil {
+		t.Errorf("Expected Migrations to be valid but got %v", err)
+	}
+
+	unordered := []Migration{{Version: 1}, {Version: 3}, {Version: 2}}
+	if err := validate(unordered); err == nil {
+		t.Errorf("Expected error for unordered migrations")
+	}
+
+	duplicated := []Migration{{Version: 1}, {Version: 1}}
+	if err := validate(duplicated); err == nil {
+		t.Errorf("Expected error for duplicated migrations")
+	}
+}
+
+func TestColumns(t *testing.T) {
+	table := Table{FieldCount: 7, TenantColumn: true, Temporal: true}
+	want := []string{"p_type", "v0", "v1", "v2", "v3", "v4", "v5", "v6", "tenant_id", "valid_from", "valid_to", "row_id"}
+	got := table.columns()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v but got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected %v but got %v", want, got)
+		}
+	}
+}
+
+func TestIsTenantIsolation(t *testing.T) {
+	expression := sql.NullString{String: "((tenant_id)::text = current_setting('app.tenant'::text, true))", Valid: true}
+	if !isTenantIsolation(expression, "app.tenant") {
+		t.Errorf("Expected %v to be the tenant isolation of app.tenant", expression.String)
+	}
+	if isTenantIsolation(expression, "app.tenant_id") {
+		t.Errorf("Expected %v not to be the tenant isolation of app.tenant_id", expression.String)
+	}
+	if isTenantIsolation(sql.NullString{}, "app.tenant") {
+		t.Errorf("Expected a missing policy not to be the tenant isolation")
+	}
+}
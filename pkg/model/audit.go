@@ -0,0 +1,94 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// AuditOperation is the change of a casbin rule an AuditEntry records
+type AuditOperation string
+
+const (
+	// AuditOperationInsert records a casbin rule inserted
+	AuditOperationInsert AuditOperation = "insert"
+	// AuditOperationDelete records a casbin rule deleted
+	AuditOperationDelete AuditOperation = "delete"
+)
+
+// AuditEntry records a change of a casbin rule. An update of a rule is recorded
+// as the deletion of the old rule followed by the insertion of the new one.
+type AuditEntry struct {
+	ID         int64
+	Operation  AuditOperation
+	CasbinRule CasbinRule
+	TenantID   string
+	// Actor is the actor taken from the context of the change, if any
+	Actor string
+	Time  time.Time
+	// Hash is the ChainHash of the entry, empty for the entries recorded before
+	// the start of the chain
+	Hash string
+}
+
+// AuditChainBreak reports the first audit entry of a tenant whose hash does not
+// match its contents chained to the hash of the entry before it, which means
+// that either entry was edited, or that entries between them were deleted
+type AuditChainBreak struct {
+	AuditEntry AuditEntry
+	// PreviousHash is the hash of the entry before it, empty for the first
+	// entry of the chain
+	PreviousHash string
+	// ExpectedHash is the hash the entry would hold if left untouched
+	ExpectedHash string
+}
+
+// AuditQuery selects a page of the audit entries, in the order recorded. Zero
+// fields are left unconstrained.
+type AuditQuery struct {
+	// AfterID skips the entries up to this id, the id of the last entry of the
+	// previous page
+	AfterID int64
+	// Limit is the maximum number of entries returned, 100 when zero
+	Limit int
+	PType string
+	Actor string
+	// Since and Until bound the time of the entries, Until excluded
+	Since time.Time
+	Until time.Time
+}
+
+// ChainHash returns the hex encoded SHA-256 hash of the contents of entry, but
+// its id and hash, chained to previousHash, the hash of the entry of the same
+// tenant before it. The time of entry is hashed in UTC. With a non-empty key,
+// the hash is an HMAC-SHA256, which cannot be computed without the key.
+func (entry AuditEntry) ChainHash(previousHash string, key []byte) string {
+	hash := sha256.New()
+	if len(key) > 0 {
+		hash = hmac.New(sha256.New, key)
+	}
+	buffer := make([]byte, binary.MaxVarintLen64)
+	writeLength := func(length int) {
+		hash.Write(buffer[:binary.PutUvarint(buffer, uint64(length))])
+	}
+	// Each field is preceded by its length, and the values by their number, so
+	// that no two entries share an encoding.
+	writeField := func(field string) {
+		writeLength(len(field))
+		hash.Write([]byte(field))
+	}
+	writeField(previousHash)
+	writeField(string(entry.Operation))
+	writeField(entry.CasbinRule.PType)
+	fields := entry.CasbinRule.Fields()
+	writeLength(len(fields))
+	for _, value := range fields {
+		writeField(value)
+	}
+	writeField(entry.TenantID)
+	writeField(entry.Actor)
+	writeField(entry.Time.UTC().Format(time.RFC3339Nano))
+	return hex.EncodeToString(hash.Sum(nil))
+}
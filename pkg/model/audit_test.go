@@ -0,0 +1,59 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChainHash(t *testing.T) {
+	entry := AuditEntry{
+		ID:         1,
+		Operation:  AuditOperationInsert,
+		CasbinRule: NewCasbinRuleFromPTypeAndRule("p", []string{"alice", "data1", "read"}),
+		TenantID:   "tenant1",
+		Actor:      "admin",
+		Time:       time.Date(2020, 1, 1, 8, 0, 0, 123456000, time.FixedZone("HKT", 8*60*60)),
+	}
+	hash := entry.ChainHash("", nil)
+	if len(hash) != 64 {
+		t.Fatalf("Expected a hex encoded SHA-256 hash but got %v", hash)
+	}
+
+	same := entry
+	same.ID = 2
+	same.Hash = hash
+	same.Time = entry.Time.UTC()
+	if got := same.ChainHash("", nil); got != hash {
+		t.Errorf("Expected %v but got %v", hash, got)
+	}
+
+	changes := []func(*AuditEntry){
+		func(e *AuditEntry) { e.Operation = AuditOperationDelete },
+		func(e *AuditEntry) { e.CasbinRule.PType = "g" },
+		func(e *AuditEntry) { e.CasbinRule.Values = []string{"alice", "data1", "write"} },
+		func(e *AuditEntry) { e.CasbinRule.Values = []string{"alice", "data1", "read", ""} },
+		func(e *AuditEntry) { e.CasbinRule.Values = []string{"alice", "data1read"} },
+		func(e *AuditEntry) { e.TenantID = "tenant2" },
+		func(e *AuditEntry) { e.Actor = "" },
+		func(e *AuditEntry) { e.Time = e.Time.Add(time.Microsecond) },
+	}
+	for i, change := range changes {
+		changed := entry
+		changed.CasbinRule.Values = append([]string(nil), entry.CasbinRule.Values...)
+		change(&changed)
+		if changed.ChainHash("", nil) == hash {
+			t.Errorf("Expected change %d to change the hash", i)
+		}
+	}
+	if entry.ChainHash(hash, nil) == hash {
+		t.Errorf("Expected the previous hash to change the hash")
+	}
+
+	keyed := entry.ChainHash("", []byte("secret"))
+	if len(keyed) != 64 || keyed == hash {
+		t.Errorf("Expected a hex encoded HMAC-SHA256 other than %v but got %v", hash, keyed)
+	}
+	if got := entry.ChainHash("", []byte("other secret")); got == keyed {
+		t.Errorf("Expected the key to change the hash")
+	}
+}
@@ -15,41 +15,32 @@ type Filter struct {
 	G []string
 }
 
-// CasbinRule is the model for casbin rule
+// DefaultFieldCount is the number of values a casbin rule has by default,
+// stored in the columns v0 to v5
+const DefaultFieldCount = 6
+
+// CasbinRule is the model for casbin rule. Values holds every field of the
+// rule, including empty ones, so its length is the number of fields.
 type CasbinRule struct {
 	PType string
-	V0    string
-	V1    string
-	V2    string
-	V3    string
-	V4    string
-	V5    string
+	// V0 to V5 hold the first six fields of the rule, as set by the
+	// constructors and the repository. A rule whose Values is nil takes its
+	// fields from them, up to the last non-empty one.
+	//
+	// Deprecated: use Values, which holds every field.
+	V0, V1, V2, V3, V4, V5 string
+	Values                 []string
 }
 
 // NewCasbinRuleFromPTypeAndRule returns a CasbinRule from pType and rule
 func NewCasbinRuleFromPTypeAndRule(pType string, rule []string) CasbinRule {
+	values := make([]string, len(rule))
+	copy(values, rule)
 	casbinRule := CasbinRule{
-		PType: pType,
-	}
-	ruleLength := len(rule)
-	if ruleLength > 0 {
-		casbinRule.V0 = rule[0]
-	}
-	if ruleLength > 1 {
-		casbinRule.V1 = rule[1]
-	}
-	if ruleLength > 2 {
-		casbinRule.V2 = rule[2]
-	}
-	if ruleLength > 3 {
-		casbinRule.V3 = rule[3]
-	}
-	if ruleLength > 4 {
-		casbinRule.V4 = rule[4]
-	}
-	if ruleLength > 5 {
-		casbinRule.V5 = rule[5]
+		PType:  pType,
+		Values: values,
 	}
+	casbinRule.setDefaultFields()
 	return casbinRule
 }
 
@@ -58,28 +49,55 @@ func NewCasbinRuleFromPTypeAndFilter(pType string, fieldIndex int, fieldValues .
 	casbinRule := CasbinRule{
 		PType: pType,
 	}
+	if fieldIndex < 0 {
+		if -fieldIndex >= len(fieldValues) {
+			fieldValues = nil
+		} else {
+			fieldValues = fieldValues[-fieldIndex:]
+		}
+		fieldIndex = 0
+	}
+	casbinRule.Values = make([]string, fieldIndex+len(fieldValues))
+	copy(casbinRule.Values[fieldIndex:], fieldValues)
+	casbinRule.setDefaultFields()
+	return casbinRule
+}
 
-	idx := fieldIndex + len(fieldValues)
-	if fieldIndex <= 0 && idx > 0 {
-		casbinRule.V0 = fieldValues[0-fieldIndex]
-	}
-	if fieldIndex <= 1 && idx > 1 {
-		casbinRule.V1 = fieldValues[1-fieldIndex]
-	}
-	if fieldIndex <= 2 && idx > 2 {
-		casbinRule.V2 = fieldValues[2-fieldIndex]
-	}
-	if fieldIndex <= 3 && idx > 3 {
-		casbinRule.V3 = fieldValues[3-fieldIndex]
-	}
-	if fieldIndex <= 4 && idx > 4 {
-		casbinRule.V4 = fieldValues[4-fieldIndex]
-	}
-	if fieldIndex <= 5 && idx > 5 {
-		casbinRule.V5 = fieldValues[5-fieldIndex]
+// setDefaultFields sets V0 to V5 from Values
+func (casbinRule *CasbinRule) setDefaultFields() {
+	for i, field := range []*string{
+		&casbinRule.V0,
+		&casbinRule.V1,
+		&casbinRule.V2,
+		&casbinRule.V3,
+		&casbinRule.V4,
+		&casbinRule.V5,
+	} {
+		*field = casbinRule.Value(i)
 	}
+}
 
-	return casbinRule
+// Fields returns the fields of the rule, Values unless it is nil, in which
+// case the rule was built from V0 to V5, whose fields up to the last non-empty
+// one are returned
+func (casbinRule CasbinRule) Fields() []string {
+	if casbinRule.Values != nil {
+		return casbinRule.Values
+	}
+	fields := []string{casbinRule.V0, casbinRule.V1, casbinRule.V2, casbinRule.V3, casbinRule.V4, casbinRule.V5}
+	for len(fields) > 0 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return fields
+}
+
+// Value returns the value at index i, or an empty string if the rule has no
+// such value
+func (casbinRule CasbinRule) Value(i int) string {
+	if fields := casbinRule.Fields(); i < len(fields) {
+		return fields[i]
+	}
+	return ""
 }
 
 // ToPolicyLine map casbinRule to a policy line used in casbin
@@ -87,29 +105,9 @@ func (casbinRule CasbinRule) ToPolicyLine() string {
 	var stringBuilder strings.Builder
 
 	stringBuilder.WriteString(casbinRule.PType)
-	if len(casbinRule.V0) > 0 {
-		stringBuilder.WriteString(policyLinePrefix)
-		stringBuilder.WriteString(casbinRule.V0)
-	}
-	if len(casbinRule.V1) > 0 {
-		stringBuilder.WriteString(policyLinePrefix)
-		stringBuilder.WriteString(casbinRule.V1)
-	}
-	if len(casbinRule.V2) > 0 {
-		stringBuilder.WriteString(policyLinePrefix)
-		stringBuilder.WriteString(casbinRule.V2)
-	}
-	if len(casbinRule.V3) > 0 {
-		stringBuilder.WriteString(policyLinePrefix)
-		stringBuilder.WriteString(casbinRule.V3)
-	}
-	if len(casbinRule.V4) > 0 {
+	for _, value := range casbinRule.Fields() {
 		stringBuilder.WriteString(policyLinePrefix)
-		stringBuilder.WriteString(casbinRule.V4)
-	}
-	if len(casbinRule.V5) > 0 {
-		stringBuilder.WriteString(policyLinePrefix)
-		stringBuilder.WriteString(casbinRule.V5)
+		stringBuilder.WriteString(value)
 	}
 
 	return stringBuilder.String()
@@ -117,26 +115,9 @@ func (casbinRule CasbinRule) ToPolicyLine() string {
 
 // ToStringSlice map casbinRule to a string slice used in casbin.Model
 func (casbinRule CasbinRule) ToStringSlice() []string {
-	rule := make([]string, 0)
+	fields := casbinRule.Fields()
+	rule := make([]string, 0, len(fields)+1)
 	rule = append(rule, casbinRule.PType)
-
-	if len(casbinRule.V0) > 0 {
-		rule = append(rule, casbinRule.V0)
-	}
-	if len(casbinRule.V1) > 0 {
-		rule = append(rule, casbinRule.V1)
-	}
-	if len(casbinRule.V2) > 0 {
-		rule = append(rule, casbinRule.V2)
-	}
-	if len(casbinRule.V3) > 0 {
-		rule = append(rule, casbinRule.V3)
-	}
-	if len(casbinRule.V4) > 0 {
-		rule = append(rule, casbinRule.V4)
-	}
-	if len(casbinRule.V5) > 0 {
-		rule = append(rule, casbinRule.V5)
-	}
+	rule = append(rule, fields...)
 	return rule
 }
@@ -1,62 +1,31 @@
 package model
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func testNewCasbinRuleFromPTypeAndRuleWithLength(t *testing.T, length int) {
 	pType := "p"
-	rule := []string{"v0", "v1", "v2", "v3", "v4", "v5"}
+	rule := []string{"v0", "v1", "v2", "v3", "v4", "v5", "v6", "v7"}
 	casbinRule := NewCasbinRuleFromPTypeAndRule(pType, rule[0:length])
-	var wantCasbinRule CasbinRule
-	switch length {
-	case 1:
-		wantCasbinRule = CasbinRule{
-			PType: "p",
-			V0:    "v0",
-		}
-	case 2:
-		wantCasbinRule = CasbinRule{
-			PType: "p",
-			V0:    "v0",
-			V1:    "v1",
-		}
-	case 3:
-		wantCasbinRule = CasbinRule{
-			PType: "p",
-			V0:    "v0",
-			V1:    "v1",
-			V2:    "v2",
-		}
-	case 4:
-		wantCasbinRule = CasbinRule{
-			PType: "p",
-			V0:    "v0",
-			V1:    "v1",
-			V2:    "v2",
-			V3:    "v3",
-		}
-	case 5:
-		wantCasbinRule = CasbinRule{
-			PType: "p",
-			V0:    "v0",
-			V1:    "v1",
-			V2:    "v2",
-			V3:    "v2",
-			V4:    "v4",
-		}
-	case 6:
-		wantCasbinRule = CasbinRule{
-			PType: "p",
-			V0:    "v0",
-			V1:    "v1",
-			V2:    "v2",
-			V3:    "v2",
-			V4:    "v4",
-			V5:    "v5",
+	wantCasbinRule := CasbinRule{
+		PType:  "p",
+		Values: []string{"v0", "v1", "v2", "v3", "v4", "v5", "v6", "v7"}[0:length],
+	}
+	for i, field := range []*string{
+		&wantCasbinRule.V0,
+		&wantCasbinRule.V1,
+		&wantCasbinRule.V2,
+		&wantCasbinRule.V3,
+		&wantCasbinRule.V4,
+		&wantCasbinRule.V5,
+	} {
+		if i < length {
+			*field = rule[i]
 		}
-	default:
-		t.Fatalf("Expected length from 1 to 6")
 	}
-	if wantCasbinRule != casbinRule {
+	if !reflect.DeepEqual(wantCasbinRule, casbinRule) {
 		t.Errorf(
 			"Test NewCasbinRuleFromPTypeAndRule with length %v. Expected %v but got %v",
 			length,
@@ -67,7 +36,88 @@ func testNewCasbinRuleFromPTypeAndRuleWithLength(t *testing.T, length int) {
 }
 
 func TestNewCasbinRuleFromPTypeAndRule(t *testing.T) {
-	for i := 1; i < 5; i++ {
+	for i := 1; i <= 8; i++ {
 		testNewCasbinRuleFromPTypeAndRuleWithLength(t, i)
 	}
+
+	rule := []string{"alice", "data1", "read"}
+	casbinRule := NewCasbinRuleFromPTypeAndRule("p", rule)
+	rule[0] = "bob"
+	if casbinRule.Values[0] != "alice" {
+		t.Errorf("Expected NewCasbinRuleFromPTypeAndRule to copy the rule")
+	}
+}
+
+func TestNewCasbinRuleFromPTypeAndFilter(t *testing.T) {
+	tests := []struct {
+		fieldIndex  int
+		fieldValues []string
+		want        []string
+	}{
+		{0, []string{"alice"}, []string{"alice"}},
+		{1, []string{"data1", "read"}, []string{"", "data1", "read"}},
+		{6, []string{"v6"}, []string{"", "", "", "", "", "", "v6"}},
+		{-1, []string{"alice", "data1"}, []string{"data1"}},
+		{-2, []string{"alice"}, []string{}},
+	}
+	for _, test := range tests {
+		casbinRule := NewCasbinRuleFromPTypeAndFilter("p", test.fieldIndex, test.fieldValues...)
+		if casbinRule.PType != "p" || !reflect.DeepEqual(casbinRule.Values, test.want) {
+			t.Errorf(
+				"Test NewCasbinRuleFromPTypeAndFilter with index %v and values %v. Expected %v but got %v",
+				test.fieldIndex,
+				test.fieldValues,
+				test.want,
+				casbinRule.Values,
+			)
+		}
+	}
+}
+
+func TestDefaultFields(t *testing.T) {
+	casbinRule := CasbinRule{PType: "p", V0: "alice", V2: "read"}
+	want := []string{"alice", "", "read"}
+	if got := casbinRule.Fields(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected %v but got %v", want, got)
+	}
+	if got := casbinRule.Value(2); got != "read" {
+		t.Errorf("Expected read but got %v", got)
+	}
+	wantLine := "p, alice, , read"
+	if got := casbinRule.ToPolicyLine(); got != wantLine {
+		t.Errorf("Expected %v but got %v", wantLine, got)
+	}
+
+	// Values takes precedence over V0 to V5.
+	casbinRule.Values = []string{"bob"}
+	if got := casbinRule.Fields(); !reflect.DeepEqual([]string{"bob"}, got) {
+		t.Errorf("Expected [bob] but got %v", got)
+	}
+}
+
+func TestToStringSlice(t *testing.T) {
+	casbinRule := CasbinRule{
+		PType:  "p",
+		Values: []string{"alice", "dom1", "data1", "read", "allow", "cond", "owner"},
+	}
+	want := []string{"p", "alice", "dom1", "data1", "read", "allow", "cond", "owner"}
+	if got := casbinRule.ToStringSlice(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected %v but got %v", want, got)
+	}
+	wantLine := "p, alice, dom1, data1, read, allow, cond, owner"
+	if got := casbinRule.ToPolicyLine(); got != wantLine {
+		t.Errorf("Expected %v but got %v", wantLine, got)
+	}
+}
+
+func TestToStringSliceKeepsEmptyValues(t *testing.T) {
+	casbinRule := NewCasbinRuleFromPTypeAndRule("p", []string{"alice", "", "read", ""})
+	want := []string{"p", "alice", "", "read", ""}
+	if got := casbinRule.ToStringSlice(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected %v but got %v", want, got)
+	}
+	wantLine := "p, alice, , read, "
+	if got := casbinRule.ToPolicyLine(); got != wantLine {
+		t.Errorf("Expected %v but got %v", wantLine, got)
+	}
 }
@@ -0,0 +1,115 @@
+package model
+
+import (
+	"fmt"
+)
+
+// Operator is the way a Condition matches the value of a field
+type Operator int
+
+const (
+	// OperatorAny matches any value. It is the operator of the zero Condition.
+	OperatorAny Operator = iota
+	// OperatorEquals matches the value equal to the value of the condition
+	OperatorEquals
+	// OperatorNotEquals matches any value but the value of the condition,
+	// including the value of a field the rule lacks
+	OperatorNotEquals
+	// OperatorPrefix matches the values starting with the value of the condition
+	OperatorPrefix
+	// OperatorLike matches the values matching the LIKE pattern of the condition
+	OperatorLike
+	// OperatorRegex matches the values matching the postgres regular expression
+	// of the condition
+	OperatorRegex
+	// OperatorIn matches the values equal to one of the values of the condition
+	OperatorIn
+)
+
+// Condition constrains the value of a field of a casbin rule
+type Condition struct {
+	Operator Operator
+	Values   []string
+}
+
+// ConditionFilter defines the filtering rules for a FilteredAdapter's policy
+// like Filter, with a condition per field. A zero condition matches any value.
+type ConditionFilter struct {
+	P []Condition
+	G []Condition
+}
+
+// PTypeFilter defines the filtering rules for a FilteredAdapter's policy per
+// ptype, such as p2 or g2. Only the rules of the ptypes it holds are loaded,
+// each matching the conditions of its ptype.
+type PTypeFilter map[string][]Condition
+
+// NewPTypeFilter returns a PTypeFilter from the field values of each ptype.
+// Non-empty values must be equal to the value of the field, while empty values
+// match any value.
+func NewPTypeFilter(values map[string][]string) PTypeFilter {
+	filter := make(PTypeFilter, len(values))
+	for pType, fieldValues := range values {
+		conditions := make([]Condition, len(fieldValues))
+		for i, fieldValue := range fieldValues {
+			if fieldValue != "" {
+				conditions[i] = Equals(fieldValue)
+			}
+		}
+		filter[pType] = conditions
+	}
+	return filter
+}
+
+// Any returns a Condition matching any value
+func Any() Condition {
+	return Condition{Operator: OperatorAny}
+}
+
+// Equals returns a Condition matching value
+func Equals(value string) Condition {
+	return Condition{Operator: OperatorEquals, Values: []string{value}}
+}
+
+// NotEquals returns a Condition matching any value but value
+func NotEquals(value string) Condition {
+	return Condition{Operator: OperatorNotEquals, Values: []string{value}}
+}
+
+// Prefix returns a Condition matching the values starting with prefix. The
+// characters of prefix have no special meaning.
+func Prefix(prefix string) Condition {
+	return Condition{Operator: OperatorPrefix, Values: []string{prefix}}
+}
+
+// Like returns a Condition matching the values matching the LIKE pattern
+func Like(pattern string) Condition {
+	return Condition{Operator: OperatorLike, Values: []string{pattern}}
+}
+
+// Regex returns a Condition matching the values matching the postgres regular
+// expression pattern
+func Regex(pattern string) Condition {
+	return Condition{Operator: OperatorRegex, Values: []string{pattern}}
+}
+
+// In returns a Condition matching the values equal to one of values
+func In(values ...string) Condition {
+	return Condition{Operator: OperatorIn, Values: values}
+}
+
+// Validate checks that condition has a known operator and as many values as
+// its operator takes
+func (condition Condition) Validate() error {
+	switch condition.Operator {
+	case OperatorAny, OperatorIn:
+		return nil
+	case OperatorEquals, OperatorNotEquals, OperatorPrefix, OperatorLike, OperatorRegex:
+		if len(condition.Values) != 1 {
+			return fmt.Errorf("condition with operator %d takes 1 value but got %d", condition.Operator, len(condition.Values))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown condition operator %d", condition.Operator)
+	}
+}
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConditionValidate(t *testing.T) {
+	validConditions := []Condition{
+		{},
+		Any(),
+		Equals("alice"),
+		NotEquals("alice"),
+		Prefix("data_"),
+		Like("data%"),
+		Regex("^data[0-9]+$"),
+		In("alice", "bob"),
+		In(),
+	}
+	for _, condition := range validConditions {
+		if err := condition.Validate(); err != nil {
+			t.Errorf("Expected condition %v to be valid but got %v", condition, err)
+		}
+	}
+
+	invalidConditions := []Condition{
+		{Operator: OperatorEquals},
+		{Operator: OperatorLike, Values: []string{"a%", "b%"}},
+		{Operator: Operator(-1)},
+	}
+	for _, condition := range invalidConditions {
+		if err := condition.Validate(); err == nil {
+			t.Errorf("Expected error for invalid condition %v", condition)
+		}
+	}
+}
+
+func TestNewPTypeFilter(t *testing.T) {
+	filter := NewPTypeFilter(map[string][]string{
+		"g2": {"", "resource_admin"},
+		"p":  {"alice"},
+	})
+	want := PTypeFilter{
+		"g2": {{}, Equals("resource_admin")},
+		"p":  {Equals("alice")},
+	}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("Expected %v but got %v", want, filter)
+	}
+}
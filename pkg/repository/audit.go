@@ -0,0 +1,360 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/cychiuae/casbin-pg-adapter/pkg/model"
+)
+
+const (
+	// defaultAuditLimit is the number of audit entries of a page when the
+	// query sets no limit
+	defaultAuditLimit = 100
+	// auditColumnCount is the number of values written per audit entry
+	auditColumnCount = 7
+)
+
+// actorContextKey is the context key of the actor recorded in the audit table
+type actorContextKey struct{}
+
+// WithActor returns a copy of ctx carrying actor, which the audit entries of
+// the changes made with it record
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// ActorFromContext returns the actor carried by ctx, or an empty string
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorContextKey{}).(string)
+	return actor
+}
+
+// WithAuditTable sets the table, in the schema of the casbin table, recording
+// each casbin rule inserted or deleted in the transaction of the change. No
+// change is recorded when it is empty, the default.
+func WithAuditTable(auditTableName string) Option {
+	return func(repository *CasbinRuleRepository) {
+		repository.auditTableName = auditTableName
+	}
+}
+
+// WithAuditKey sets the key of the HMAC-SHA256 chaining the audit entries, so
+// that the chain cannot be recomputed after editing the audit table without it.
+// The entries are chained by a plain SHA-256 when it is empty, the default.
+func WithAuditKey(auditKey []byte) Option {
+	return func(repository *CasbinRuleRepository) {
+		repository.auditKey = auditKey
+	}
+}
+
+// lockAudit takes the audit lock of the tenant of the repository within tx,
+// which beginTx does first in the transactions making changes. The lock keeps
+// the entries of the tenant from being chained to the same entry by concurrent
+// transactions, and is held until tx ends, so that the entries are also
+// committed in the order of the chain. It is taken before any row is locked,
+// lest a transaction holding the lock wait on a row locked by another waiting
+// for the lock.
+func (repository *CasbinRuleRepository) lockAudit(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`SELECT pg_advisory_xact_lock(hashtext($1))`,
+		fmt.Sprintf("casbin-pg-adapter:audit:%s.%s:%s", repository.dbSchema, repository.auditTableName, repository.tenantID),
+	)
+	return err
+}
+
+// audit records that casbinRules went through operation in the audit table,
+// if any, within tx, which holds the audit lock of the tenant. Each entry is
+// chained to the entry of the tenant before it by its hash, or to none for the
+// first entry after the start of the chain.
+func (repository *CasbinRuleRepository) audit(ctx context.Context, tx *sql.Tx, operation model.AuditOperation, casbinRules []model.CasbinRule) error {
+	if repository.auditTableName == "" || len(casbinRules) == 0 {
+		return nil
+	}
+	var now time.Time
+	var previousHash string
+	err := tx.QueryRowContext(
+		ctx,
+		fmt.Sprintf(`
+			SELECT now(), COALESCE((
+				SELECT hash FROM "%[1]s"."%[2]s"
+				WHERE tenant_id = $1 AND id > (SELECT min(start_id) FROM "%[1]s"."%[2]s_chain")
+				ORDER BY id DESC
+				LIMIT 1
+			), '')
+		`, repository.dbSchema, repository.auditTableName),
+		repository.tenantID,
+	).Scan(&now, &previousHash)
+	if err != nil {
+		return err
+	}
+	auditEntry := model.AuditEntry{
+		Operation: operation,
+		TenantID:  repository.tenantID,
+		Actor:     ActorFromContext(ctx),
+		Time:      now,
+	}
+	maxEntriesPerStatement := maxParametersPerStatement / auditColumnCount
+	for start := 0; start < len(casbinRules); start += maxEntriesPerStatement {
+		end := start + maxEntriesPerStatement
+		if end > len(casbinRules) {
+			end = len(casbinRules)
+		}
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*auditColumnCount)
+		for _, casbinRule := range casbinRules[start:end] {
+			auditEntry.CasbinRule = casbinRule
+			previousHash = auditEntry.ChainHash(previousHash, repository.auditKey)
+			ruleValues := casbinRule.Fields()
+			// pq.Array sends a nil slice as NULL rather than as an empty array.
+			if ruleValues == nil {
+				ruleValues = []string{}
+			}
+			args = append(
+				args,
+				string(operation),
+				casbinRule.PType,
+				pq.Array(ruleValues),
+				auditEntry.TenantID,
+				auditEntry.Actor,
+				auditEntry.Time,
+				previousHash,
+			)
+			placeholders := make([]string, 0, auditColumnCount)
+			for i := len(args) - auditColumnCount + 1; i <= len(args); i++ {
+				placeholders = append(placeholders, fmt.Sprintf("$%d", i))
+			}
+			values = append(values, fmt.Sprintf("(%s)", strings.Join(placeholders, ", ")))
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			fmt.Sprintf(`
+				INSERT INTO "%s"."%s" (operation, p_type, rule_values, tenant_id, actor, created_at, hash)
+				VALUES %s
+			`, repository.dbSchema, repository.auditTableName, strings.Join(values, ", ")),
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadAuditEntries returns the page of the audit entries of the tenant of the
+// repository selected by query, in the order recorded
+func (repository *CasbinRuleRepository) LoadAuditEntries(query model.AuditQuery) ([]model.AuditEntry, error) {
+	return repository.LoadAuditEntriesCtx(context.Background(), query)
+}
+
+// LoadAuditEntriesCtx is LoadAuditEntries with a context.Context
+func (repository *CasbinRuleRepository) LoadAuditEntriesCtx(ctx context.Context, query model.AuditQuery) ([]model.AuditEntry, error) {
+	if repository.auditTableName == "" {
+		return nil, errors.New("audit table is not enabled")
+	}
+	where, args, err := auditQueryWhere(query)
+	if err != nil {
+		return nil, err
+	}
+	limit := query.Limit
+	if limit == 0 {
+		limit = defaultAuditLimit
+	}
+	// The audit table always has a tenant_id column, so unlike the casbin table
+	// it is filtered on the tenant of the repository regardless of tenantColumn.
+	args = append(args, repository.tenantID, limit)
+	tx, err := repository.beginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %s FROM "%s"."%s"
+		WHERE
+			%s AND tenant_id = $%d
+		ORDER BY id
+		LIMIT $%d
+	`, auditEntryColumnList, repository.dbSchema, repository.auditTableName, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	auditEntries := make([]model.AuditEntry, 0)
+	for rows.Next() {
+		auditEntry, err := scanAuditEntry(rows)
+		if err != nil {
+			rows.Close()
+			_ = tx.Rollback()
+			return nil, err
+		}
+		auditEntries = append(auditEntries, auditEntry)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return auditEntries, nil
+}
+
+// auditEntryColumnList are the columns of the audit table scanned by
+// scanAuditEntry
+const auditEntryColumnList = "id, operation, p_type, rule_values, tenant_id, actor, created_at, hash"
+
+// scanAuditEntry scans an audit entry from the current row, which holds the
+// columns of auditEntryColumnList
+func scanAuditEntry(rows *sql.Rows) (model.AuditEntry, error) {
+	var auditEntry model.AuditEntry
+	var operation, pType string
+	var ruleValues []string
+	var hash sql.NullString
+	err := rows.Scan(
+		&auditEntry.ID,
+		&operation,
+		&pType,
+		pq.Array(&ruleValues),
+		&auditEntry.TenantID,
+		&auditEntry.Actor,
+		&auditEntry.Time,
+		&hash,
+	)
+	if err != nil {
+		return model.AuditEntry{}, err
+	}
+	auditEntry.Operation = model.AuditOperation(operation)
+	auditEntry.CasbinRule = model.NewCasbinRuleFromPTypeAndRule(pType, ruleValues)
+	auditEntry.Hash = hash.String
+	return auditEntry, nil
+}
+
+// VerifyAuditChain walks the audit entries of the tenant of the repository in
+// the order recorded and returns the first one whose hash does not chain to the
+// entry before it, or nil when the chain is intact. The chain starts after the
+// entries recorded before the audit table had the hash column, as recorded in
+// the chain table by the migration adding it, and every entry after that start
+// must hold a hash. The deletion of the last entries cannot be told.
+func (repository *CasbinRuleRepository) VerifyAuditChain() (*model.AuditChainBreak, error) {
+	return repository.VerifyAuditChainCtx(context.Background())
+}
+
+// VerifyAuditChainCtx is VerifyAuditChain with a context.Context
+func (repository *CasbinRuleRepository) VerifyAuditChainCtx(ctx context.Context) (*model.AuditChainBreak, error) {
+	if repository.auditTableName == "" {
+		return nil, errors.New("audit table is not enabled")
+	}
+	tx, err := repository.beginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	var startID sql.NullInt64
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT min(start_id) FROM "%s"."%s_chain"
+	`, repository.dbSchema, repository.auditTableName)).Scan(&startID)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	// The start of the chain is only missing when the chain table was tampered
+	// with, since the migration creating it records the start.
+	if !startID.Valid {
+		_ = tx.Rollback()
+		return nil, fmt.Errorf(`audit chain table "%s"."%s_chain" holds no start`, repository.dbSchema, repository.auditTableName)
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %s FROM "%s"."%s"
+		WHERE
+			tenant_id = $1 AND id > $2
+		ORDER BY id
+	`, auditEntryColumnList, repository.dbSchema, repository.auditTableName), repository.tenantID, startID.Int64)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	auditChainBreak, err := verifyAuditChain(rows, repository.auditKey)
+	rows.Close()
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return auditChainBreak, nil
+}
+
+// verifyAuditChain returns the first audit entry of rows, ordered by id, which
+// breaks the chain hashed with key
+func verifyAuditChain(rows *sql.Rows, key []byte) (*model.AuditChainBreak, error) {
+	chain := auditChain{key: key}
+	for rows.Next() {
+		auditEntry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		if auditChainBreak := chain.next(auditEntry); auditChainBreak != nil {
+			return auditChainBreak, nil
+		}
+	}
+	return nil, rows.Err()
+}
+
+// auditChain follows the hash chain of the audit entries of a tenant from its
+// start
+type auditChain struct {
+	key          []byte
+	previousHash string
+}
+
+// next checks that auditEntry, the entry recorded after those already checked,
+// is chained to them, and returns the break it makes otherwise. An entry
+// without a hash breaks the chain.
+func (chain *auditChain) next(auditEntry model.AuditEntry) *model.AuditChainBreak {
+	expectedHash := auditEntry.ChainHash(chain.previousHash, chain.key)
+	if auditEntry.Hash != expectedHash {
+		return &model.AuditChainBreak{
+			AuditEntry:   auditEntry,
+			PreviousHash: chain.previousHash,
+			ExpectedHash: expectedHash,
+		}
+	}
+	chain.previousHash = auditEntry.Hash
+	return nil
+}
+
+// auditQueryWhere returns the where clause matching the audit entries selected
+// by query, but for their tenant, and its arguments
+func auditQueryWhere(query model.AuditQuery) (string, []interface{}, error) {
+	if query.Limit < 0 {
+		return "", nil, fmt.Errorf("audit query limit must not be negative but got %d", query.Limit)
+	}
+	conditions := []string{"id > $1"}
+	args := []interface{}{query.AfterID}
+	if query.PType != "" {
+		args = append(args, query.PType)
+		conditions = append(conditions, fmt.Sprintf("p_type = $%d", len(args)))
+	}
+	if query.Actor != "" {
+		args = append(args, query.Actor)
+		conditions = append(conditions, fmt.Sprintf("actor = $%d", len(args)))
+	}
+	if !query.Since.IsZero() {
+		args = append(args, query.Since)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !query.Until.IsZero() {
+		args = append(args, query.Until)
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+	return strings.Join(conditions, " AND "), args, nil
+}
@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cychiuae/casbin-pg-adapter/pkg/model"
+)
+
+func TestActorFromContext(t *testing.T) {
+	if actor := ActorFromContext(context.Background()); actor != "" {
+		t.Errorf("Expected no actor but got %v", actor)
+	}
+	ctx := WithActor(context.Background(), "alice")
+	if actor := ActorFromContext(ctx); actor != "alice" {
+		t.Errorf("Expected alice but got %v", actor)
+	}
+}
+
+func TestAuditQueryWhere(t *testing.T) {
+	where, args, err := auditQueryWhere(model.AuditQuery{})
+	if err != nil {
+		t.Fatalf("Cannot compile query %v", err)
+	}
+	if where != "id > $1" || !reflect.DeepEqual(args, []interface{}{int64(0)}) {
+		t.Errorf("Unexpected where %v with args %v", where, args)
+	}
+
+	since := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := since.Add(time.Hour)
+	where, args, err = auditQueryWhere(model.AuditQuery{
+		AfterID: 42,
+		Limit:   10,
+		PType:   "p",
+		Actor:   "alice",
+		Since:   since,
+		Until:   until,
+	})
+	if err != nil {
+		t.Fatalf("Cannot compile query %v", err)
+	}
+	wantWhere := "id > $1 AND p_type = $2 AND actor = $3 AND created_at >= $4 AND created_at < $5"
+	if where != wantWhere {
+		t.Errorf("Expected %v but got %v", wantWhere, where)
+	}
+	wantArgs := []interface{}{int64(42), "p", "alice", since, until}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("Expected %v but got %v", wantArgs, args)
+	}
+
+	if _, _, err = auditQueryWhere(model.AuditQuery{Limit: -1}); err == nil {
+		t.Errorf("Expected error for negative limit")
+	}
+}
+
+func TestLoadAuditEntriesWithoutAuditTable(t *testing.T) {
+	repository := NewCasbinRuleRepository("public", "casbin_rule", nil)
+	if _, err := repository.LoadAuditEntries(model.AuditQuery{}); err == nil {
+		t.Errorf("Expected error without audit table")
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	key := []byte("secret")
+	auditEntries := make([]model.AuditEntry, 0)
+	previousHash := ""
+	for i, value := range []string{"carol", "dave", "eve"} {
+		auditEntry := model.AuditEntry{
+			ID:         int64(i + 3),
+			Operation:  model.AuditOperationDelete,
+			CasbinRule: model.NewCasbinRuleFromPTypeAndRule("p", []string{value, "data2", "write"}),
+			Actor:      "admin",
+			Time:       time.Date(2020, 1, 1, 0, 0, i, 0, time.UTC),
+		}
+		auditEntry.Hash = auditEntry.ChainHash(previousHash, key)
+		previousHash = auditEntry.Hash
+		auditEntries = append(auditEntries, auditEntry)
+	}
+	verify := func(auditEntries []model.AuditEntry, key []byte) *model.AuditChainBreak {
+		chain := auditChain{key: key}
+		for _, auditEntry := range auditEntries {
+			if auditChainBreak := chain.next(auditEntry); auditChainBreak != nil {
+				return auditChainBreak
+			}
+		}
+		return nil
+	}
+	if auditChainBreak := verify(auditEntries, key); auditChainBreak != nil {
+		t.Fatalf("Expected an intact chain but got a break at %v", auditChainBreak.AuditEntry.ID)
+	}
+	if auditChainBreak := verify(auditEntries, nil); auditChainBreak == nil || auditChainBreak.AuditEntry.ID != 3 {
+		t.Errorf("Expected a break at 3 without the key but got %v", auditChainBreak)
+	}
+
+	edited := append([]model.AuditEntry(nil), auditEntries...)
+	edited[1].Actor = "eve"
+	if auditChainBreak := verify(edited, key); auditChainBreak == nil || auditChainBreak.AuditEntry.ID != 4 {
+		t.Errorf("Expected a break at 4 but got %v", auditChainBreak)
+	}
+
+	deleted := append(append([]model.AuditEntry(nil), auditEntries[:1]...), auditEntries[2:]...)
+	auditChainBreak := verify(deleted, key)
+	if auditChainBreak == nil || auditChainBreak.AuditEntry.ID != 5 || auditChainBreak.PreviousHash != auditEntries[0].Hash {
+		t.Errorf("Expected a break at 5 but got %v", auditChainBreak)
+	}
+
+	unhashed := append([]model.AuditEntry(nil), auditEntries...)
+	unhashed[2].Hash = ""
+	if auditChainBreak := verify(unhashed, key); auditChainBreak == nil || auditChainBreak.AuditEntry.ID != 5 {
+		t.Errorf("Expected a break at 5 but got %v", auditChainBreak)
+	}
+
+	// Clearing every hash, to pass the entries off as recorded before the start
+	// of the chain, breaks it at the first one.
+	cleared := append([]model.AuditEntry(nil), auditEntries...)
+	for i := range cleared {
+		cleared[i].Hash = ""
+	}
+	cleared[1].Actor = "eve"
+	if auditChainBreak := verify(cleared, key); auditChainBreak == nil || auditChainBreak.AuditEntry.ID != 3 {
+		t.Errorf("Expected a break at 3 but got %v", auditChainBreak)
+	}
+}
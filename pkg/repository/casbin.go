@@ -1,118 +1,441 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 
 	"github.com/cychiuae/casbin-pg-adapter/pkg/model"
 )
 
+const (
+	// maxParametersPerStatement is the number of bind parameters postgres
+	// accepts in a single statement
+	maxParametersPerStatement = 65535
+	// maxRowIDsPerStatement bounds the size of the row id array sent at once
+	maxRowIDsPerStatement = 10000
+)
+
 // CasbinRuleRepository is the bridge for adapter and db
 type CasbinRuleRepository struct {
-	dbSchema  string
-	tableName string
-	db        *sql.DB
+	dbSchema   string
+	tableName  string
+	db         *sql.DB
+	fieldCount int
+	// tenantColumn is whether the table has a tenant_id column, in which case
+	// the repository only applies to the rows of tenantID
+	tenantColumn bool
+	tenantID     string
+	// rowLevelSecuritySetting is the session variable the row level security
+	// policy of the table compares tenant_id to, if any
+	rowLevelSecuritySetting string
+	// auditTableName is the table recording the changes of the casbin rules,
+	// if any
+	auditTableName string
+	// auditKey is the key of the HMAC chaining the audit entries, if any
+	auditKey []byte
+	// temporal is whether the rows removed are closed out by setting their
+	// valid_to column rather than deleted
+	temporal bool
+}
+
+// Option configures a CasbinRuleRepository
+type Option func(*CasbinRuleRepository)
+
+// WithFieldCount sets the number of value columns of the table, v0 to
+// v<fieldCount-1>. It defaults to model.DefaultFieldCount.
+func WithFieldCount(fieldCount int) Option {
+	return func(repository *CasbinRuleRepository) {
+		repository.fieldCount = fieldCount
+	}
+}
+
+// WithTenantColumn sets whether the table has a tenant_id column. The
+// repository then only applies to the rows of its tenant, the empty one unless
+// set by ForTenant.
+func WithTenantColumn(tenantColumn bool) Option {
+	return func(repository *CasbinRuleRepository) {
+		repository.tenantColumn = tenantColumn
+	}
+}
+
+// WithRowLevelSecurity sets the session variable the row level security policy
+// of the table compares tenant_id to. Each transaction of the repository sets
+// it to the tenant of the repository. It requires WithTenantColumn.
+func WithRowLevelSecurity(setting string) Option {
+	return func(repository *CasbinRuleRepository) {
+		repository.rowLevelSecuritySetting = setting
+	}
+}
+
+// WithTemporal sets whether the table has the valid_from, valid_to and row_id
+// columns,
+// in which case the rows removed are closed out rather than deleted, so that
+// LoadCasbinRulesAsOf can load the casbin rules of any past instant. The
+// repository otherwise only applies to the current rows, whose valid_to is NULL.
+func WithTemporal(temporal bool) Option {
+	return func(repository *CasbinRuleRepository) {
+		repository.temporal = temporal
+	}
 }
 
 // NewCasbinRuleRepository returns a new CasbinRuleRepository
-func NewCasbinRuleRepository(dbSchema string, tableName string, db *sql.DB) *CasbinRuleRepository {
-	return &CasbinRuleRepository{
-		dbSchema:  dbSchema,
-		tableName: tableName,
-		db:        db,
+func NewCasbinRuleRepository(dbSchema string, tableName string, db *sql.DB, opts ...Option) *CasbinRuleRepository {
+	repository := &CasbinRuleRepository{
+		dbSchema:   dbSchema,
+		tableName:  tableName,
+		db:         db,
+		fieldCount: model.DefaultFieldCount,
+	}
+	for _, opt := range opts {
+		opt(repository)
 	}
+	return repository
 }
 
-// LoadAllCasbinRules loads all casbin rules from db
-func (repository *CasbinRuleRepository) LoadAllCasbinRules() ([]model.CasbinRule, error) {
-	rows, err := repository.db.Query(fmt.Sprintf(`
-		SELECT p_type, v0, v1, v2, v3, v4, v5 FROM "%s"."%s"
-	`, repository.dbSchema, repository.tableName))
+// columns returns the columns of the table, p_type followed by the value columns
+func (repository *CasbinRuleRepository) columns() []string {
+	columns := make([]string, 0, repository.fieldCount+1)
+	columns = append(columns, "p_type")
+	for i := 0; i < repository.fieldCount; i++ {
+		columns = append(columns, fmt.Sprintf("v%d", i))
+	}
+	return columns
+}
+
+// columnList returns the columns of the table as used in a statement
+func (repository *CasbinRuleRepository) columnList() string {
+	return strings.Join(repository.columns(), ", ")
+}
+
+// writeColumns returns the columns written for a casbin rule, the columns of
+// the table followed by tenant_id when the table has it
+func (repository *CasbinRuleRepository) writeColumns() []string {
+	columns := repository.columns()
+	if repository.tenantColumn {
+		columns = append(columns, "tenant_id")
+	}
+	return columns
+}
+
+// writeColumnList returns the columns written for a casbin rule as used in a
+// statement
+func (repository *CasbinRuleRepository) writeColumnList() string {
+	return strings.Join(repository.writeColumns(), ", ")
+}
+
+// ForTenant returns a copy of repository which only applies to the rows of
+// tenantID. It requires the tenant_id column.
+func (repository *CasbinRuleRepository) ForTenant(tenantID string) (*CasbinRuleRepository, error) {
+	if !repository.tenantColumn {
+		return nil, fmt.Errorf(`table "%s"."%s" has no tenant column`, repository.dbSchema, repository.tableName)
+	}
+	tenantRepository := *repository
+	tenantRepository.tenantID = tenantID
+	return &tenantRepository, nil
+}
+
+// beginTx starts a transaction in which the row level security setting, if any,
+// holds the tenant of the repository. A transaction which is not read-only
+// takes the audit lock of the tenant first when the changes are audited.
+func (repository *CasbinRuleRepository) beginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	tx, err := repository.db.BeginTx(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	return loadPolicyFromRows(rows)
+	if repository.rowLevelSecuritySetting != "" {
+		// set_config with is_local is SET LOCAL taking parameters, so the
+		// setting is reset when the transaction ends.
+		_, err = tx.ExecContext(
+			ctx,
+			`SELECT set_config($1, $2, true)`,
+			repository.rowLevelSecuritySetting,
+			repository.tenantID,
+		)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+	if repository.auditTableName != "" && (opts == nil || !opts.ReadOnly) {
+		if err = repository.lockAudit(ctx, tx); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// scopeCondition returns the where condition matching the rows the repository
+// applies to, the current rows of its tenant, with its values appended to args
+func (repository *CasbinRuleRepository) scopeCondition(args []interface{}) (string, []interface{}) {
+	scope, args := repository.tenantCondition(args)
+	if !repository.temporal {
+		return scope, args
+	}
+	if scope == "true" {
+		return "valid_to IS NULL", args
+	}
+	return fmt.Sprintf("%s AND valid_to IS NULL", scope), args
+}
+
+// tenantCondition returns the where condition matching the rows of the tenant
+// of the repository, current or not, with its values appended to args
+func (repository *CasbinRuleRepository) tenantCondition(args []interface{}) (string, []interface{}) {
+	if !repository.tenantColumn {
+		return "true", args
+	}
+	args = append(args, repository.tenantID)
+	return fmt.Sprintf("tenant_id = $%d", len(args)), args
+}
+
+// removeStatement returns the statement removing the rows matching the where
+// clause. In temporal mode, the rows are closed out rather than deleted.
+func (repository *CasbinRuleRepository) removeStatement(where string) string {
+	if repository.temporal {
+		return fmt.Sprintf(`
+			UPDATE "%s"."%s"
+			SET valid_to = now()
+			WHERE
+				%s
+		`, repository.dbSchema, repository.tableName, where)
+	}
+	return fmt.Sprintf(`
+		DELETE FROM "%s"."%s"
+		WHERE
+			%s
+	`, repository.dbSchema, repository.tableName, where)
+}
+
+// maxRulesPerStatement is the number of casbin rules which can be written by a
+// single statement without exceeding maxParametersPerStatement
+func (repository *CasbinRuleRepository) maxRulesPerStatement() int {
+	return maxParametersPerStatement / len(repository.writeColumns())
+}
+
+// values returns the values written for casbinRule, in the order of
+// writeColumns. The columns of the values it lacks are NULL, unlike the columns
+// of its empty values.
+func (repository *CasbinRuleRepository) values(casbinRule model.CasbinRule) ([]interface{}, error) {
+	fields := casbinRule.Fields()
+	if len(fields) > repository.fieldCount {
+		return nil, fmt.Errorf(
+			"casbin rule has %d values but the table has %d value columns",
+			len(fields),
+			repository.fieldCount,
+		)
+	}
+	values := make([]interface{}, 0, repository.fieldCount+1)
+	values = append(values, casbinRule.PType)
+	for i := 0; i < repository.fieldCount; i++ {
+		if i < len(fields) {
+			values = append(values, fields[i])
+		} else {
+			values = append(values, nil)
+		}
+	}
+	if repository.tenantColumn {
+		values = append(values, repository.tenantID)
+	}
+	return values, nil
+}
+
+// key returns a string identifying casbinRule, its number of values included
+func (repository *CasbinRuleRepository) key(casbinRule model.CasbinRule) string {
+	var keyBuilder strings.Builder
+	keyBuilder.WriteString(casbinRule.PType)
+	for _, value := range casbinRule.Fields() {
+		// Postgres text cannot hold NUL, so it cannot appear inside a value.
+		keyBuilder.WriteString("\x00")
+		keyBuilder.WriteString(value)
+	}
+	return keyBuilder.String()
+}
+
+// LoadAllCasbinRules loads all casbin rules from db
+func (repository *CasbinRuleRepository) LoadAllCasbinRules() ([]model.CasbinRule, error) {
+	return repository.LoadAllCasbinRulesCtx(context.Background())
+}
+
+// LoadAllCasbinRulesCtx is LoadAllCasbinRules with a context.Context
+func (repository *CasbinRuleRepository) LoadAllCasbinRulesCtx(ctx context.Context) ([]model.CasbinRule, error) {
+	return repository.loadWhere(ctx, "true", nil)
 }
 
 // LoadFilteredRules loads casbin rules filtered
 func (repository *CasbinRuleRepository) LoadFilteredRules(filter *model.Filter) ([]model.CasbinRule, error) {
-	pFilter, gFilter := filteredWhereValues(filter)
-	rows, err := repository.db.Query(fmt.Sprintf(`
-		SELECT p_type, v0, v1, v2, v3, v4, v5 FROM "%s"."%s"
-		 WHERE 
-            ( p_type LIKE 'g%%' AND v0 LIKE $1 AND v1 LIKE $2 AND v2 LIKE $3 AND v3 LIKE $4 AND v4 LIKE $5 AND v5 LIKE $6 )
-        OR 
-            ( p_type LIKE 'p%%' AND v0 LIKE $7 AND v1 LIKE $8 AND v2 LIKE $9 AND v3 LIKE $10 AND v4 LIKE $11 AND v5 LIKE $12 )
-	`, repository.dbSchema, repository.tableName),
-		gFilter[0], gFilter[1], gFilter[2], gFilter[3], gFilter[4], gFilter[5],
-		pFilter[0], pFilter[1], pFilter[2], pFilter[3], pFilter[4], pFilter[5],
+	return repository.LoadFilteredRulesCtx(context.Background(), filter)
+}
+
+// LoadFilteredRulesCtx is LoadFilteredRules with a context.Context
+func (repository *CasbinRuleRepository) LoadFilteredRulesCtx(ctx context.Context, filter *model.Filter) ([]model.CasbinRule, error) {
+	where, args, err := repository.filterWhere(filter, make([]interface{}, 0))
+	if err != nil {
+		return nil, err
+	}
+	return repository.loadWhere(ctx, where, args)
+}
+
+// LoadConditionFilteredRules loads the casbin rules matching filter
+func (repository *CasbinRuleRepository) LoadConditionFilteredRules(filter *model.ConditionFilter) ([]model.CasbinRule, error) {
+	return repository.LoadConditionFilteredRulesCtx(context.Background(), filter)
+}
+
+// LoadConditionFilteredRulesCtx is LoadConditionFilteredRules with a context.Context
+func (repository *CasbinRuleRepository) LoadConditionFilteredRulesCtx(ctx context.Context, filter *model.ConditionFilter) ([]model.CasbinRule, error) {
+	where, args, err := repository.conditionFilterWhere(filter, make([]interface{}, 0))
+	if err != nil {
+		return nil, err
+	}
+	return repository.loadWhere(ctx, where, args)
+}
+
+// LoadPTypeFilteredRules loads the casbin rules of the ptypes of filter which
+// match the conditions of their ptype
+func (repository *CasbinRuleRepository) LoadPTypeFilteredRules(filter model.PTypeFilter) ([]model.CasbinRule, error) {
+	return repository.LoadPTypeFilteredRulesCtx(context.Background(), filter)
+}
+
+// LoadPTypeFilteredRulesCtx is LoadPTypeFilteredRules with a context.Context
+func (repository *CasbinRuleRepository) LoadPTypeFilteredRulesCtx(ctx context.Context, filter model.PTypeFilter) ([]model.CasbinRule, error) {
+	where, args, err := repository.pTypeFilterWhere(filter, make([]interface{}, 0))
+	if err != nil {
+		return nil, err
+	}
+	return repository.loadWhere(ctx, where, args)
+}
+
+// LoadCasbinRulesAsOf loads the casbin rules of the tenant of the repository
+// which were in db at the instant asOf. It requires temporal mode.
+func (repository *CasbinRuleRepository) LoadCasbinRulesAsOf(asOf time.Time) ([]model.CasbinRule, error) {
+	return repository.LoadCasbinRulesAsOfCtx(context.Background(), asOf)
+}
+
+// LoadCasbinRulesAsOfCtx is LoadCasbinRulesAsOf with a context.Context
+func (repository *CasbinRuleRepository) LoadCasbinRulesAsOfCtx(ctx context.Context, asOf time.Time) ([]model.CasbinRule, error) {
+	if !repository.temporal {
+		return nil, fmt.Errorf(`table "%s"."%s" is not temporal`, repository.dbSchema, repository.tableName)
+	}
+	tenant, args := repository.tenantCondition([]interface{}{asOf})
+	// A row is valid from valid_from included to valid_to excluded, so a rule
+	// replaced at asOf is loaded in its new form. The rows are loaded in the
+	// order they were inserted, which row_id breaks the ties of valid_from in.
+	return repository.loadRows(
+		ctx,
+		fmt.Sprintf("valid_from <= $1 AND (valid_to IS NULL OR valid_to > $1) AND %s", tenant),
+		"valid_from, row_id",
+		args,
 	)
+}
+
+// loadWhere loads the casbin rules matching the where clause
+func (repository *CasbinRuleRepository) loadWhere(ctx context.Context, where string, args []interface{}) ([]model.CasbinRule, error) {
+	scope, args := repository.scopeCondition(args)
+	return repository.loadRows(ctx, fmt.Sprintf("( %s ) AND %s", where, scope), "", args)
+}
+
+// loadRows loads the casbin rules of the rows matching the where clause, which
+// unlike the one of loadWhere is not limited to the rows the repository applies
+// to, ordered by the columns of orderBy unless it is empty
+func (repository *CasbinRuleRepository) loadRows(ctx context.Context, where string, orderBy string, args []interface{}) ([]model.CasbinRule, error) {
+	tx, err := repository.beginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	orderClause := ""
+	if orderBy != "" {
+		orderClause = "ORDER BY " + orderBy
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %s FROM "%s"."%s"
+		WHERE
+			%s
+		%s
+	`, repository.columnList(), repository.dbSchema, repository.tableName, where, orderClause), args...)
 	if err != nil {
+		_ = tx.Rollback()
 		return nil, err
 	}
-	defer rows.Close()
-	return loadPolicyFromRows(rows)
+	casbinRules, err := repository.loadPolicyFromRows(rows)
+	rows.Close()
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return casbinRules, nil
 }
 
-func loadPolicyFromRows(rows *sql.Rows) ([]model.CasbinRule, error) {
+func (repository *CasbinRuleRepository) loadPolicyFromRows(rows *sql.Rows) ([]model.CasbinRule, error) {
 	casbinRules := make([]model.CasbinRule, 0)
 	for rows.Next() {
-		var pType string
-		var v0 string
-		var v1 string
-		var v2 string
-		var v3 string
-		var v4 string
-		var v5 string
-		scanErr := rows.Scan(
-			&pType,
-			&v0,
-			&v1,
-			&v2,
-			&v3,
-			&v4,
-			&v5,
-		)
+		casbinRule, scanErr := repository.scanCasbinRule(rows)
 		if scanErr != nil {
 			return nil, scanErr
 		}
-		casbinRule := model.CasbinRule{
-			PType: pType,
-			V0:    v0,
-			V1:    v1,
-			V2:    v2,
-			V3:    v3,
-			V4:    v4,
-			V5:    v5,
-		}
 		casbinRules = append(casbinRules, casbinRule)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 	return casbinRules, nil
 }
 
+// scanCasbinRule scans a casbin rule from the current row, which holds the
+// columns of the table preceded by extraDest. The values of the rule end
+// before its first NULL column.
+func (repository *CasbinRuleRepository) scanCasbinRule(rows *sql.Rows, extraDest ...interface{}) (model.CasbinRule, error) {
+	var pType string
+	values := make([]sql.NullString, repository.fieldCount)
+	dest := make([]interface{}, 0, len(extraDest)+repository.fieldCount+1)
+	dest = append(dest, extraDest...)
+	dest = append(dest, &pType)
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return model.CasbinRule{}, err
+	}
+	rule := make([]string, 0, len(values))
+	for _, value := range values {
+		if !value.Valid {
+			break
+		}
+		rule = append(rule, value.String)
+	}
+	return model.NewCasbinRuleFromPTypeAndRule(pType, rule), nil
+}
+
 // InsertCasbinRule insert a casbin rule into db
 func (repository *CasbinRuleRepository) InsertCasbinRule(casbinRule model.CasbinRule) error {
-	tx, err := repository.db.Begin()
+	return repository.InsertCasbinRuleCtx(context.Background(), casbinRule)
+}
+
+// InsertCasbinRuleCtx is InsertCasbinRule with a context.Context
+func (repository *CasbinRuleRepository) InsertCasbinRuleCtx(ctx context.Context, casbinRule model.CasbinRule) error {
+	return repository.InsertCasbinRulesCtx(ctx, []model.CasbinRule{casbinRule})
+}
+
+// InsertCasbinRules inserts casbin rules into db in a single transaction
+func (repository *CasbinRuleRepository) InsertCasbinRules(casbinRules []model.CasbinRule) error {
+	return repository.InsertCasbinRulesCtx(context.Background(), casbinRules)
+}
+
+// InsertCasbinRulesCtx is InsertCasbinRules with a context.Context
+func (repository *CasbinRuleRepository) InsertCasbinRulesCtx(ctx context.Context, casbinRules []model.CasbinRule) error {
+	tx, err := repository.beginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	_, err = tx.Exec(
-		fmt.Sprintf(`
-			INSERT INTO "%s"."%s" (p_type, v0, v1, v2, v3, v4, v5)
-			VALUES
-				($1, $2, $3, $4, $5, $6, $7)
-		`, repository.dbSchema, repository.tableName),
-		casbinRule.PType,
-		casbinRule.V0,
-		casbinRule.V1,
-		casbinRule.V2,
-		casbinRule.V3,
-		casbinRule.V4,
-		casbinRule.V5,
-	)
-	if err != nil {
+	if err = repository.insertCasbinRules(ctx, tx, casbinRules); err != nil {
 		_ = tx.Rollback()
 		return err
 	}
@@ -123,54 +446,457 @@ func (repository *CasbinRuleRepository) InsertCasbinRule(casbinRule model.Casbin
 	return nil
 }
 
-// DeleteCasbinRule insert a casbin rule into db
+func (repository *CasbinRuleRepository) insertCasbinRules(ctx context.Context, tx *sql.Tx, casbinRules []model.CasbinRule) error {
+	maxRulesPerStatement := repository.maxRulesPerStatement()
+	for start := 0; start < len(casbinRules); start += maxRulesPerStatement {
+		end := start + maxRulesPerStatement
+		if end > len(casbinRules) {
+			end = len(casbinRules)
+		}
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*(repository.fieldCount+1))
+		for _, casbinRule := range casbinRules[start:end] {
+			casbinRuleValues, err := repository.values(casbinRule)
+			if err != nil {
+				return err
+			}
+			placeholders := make([]string, 0, len(casbinRuleValues))
+			for i := 1; i <= len(casbinRuleValues); i++ {
+				placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)+i))
+			}
+			values = append(values, fmt.Sprintf("(%s)", strings.Join(placeholders, ", ")))
+			args = append(args, casbinRuleValues...)
+		}
+		_, err := tx.ExecContext(
+			ctx,
+			fmt.Sprintf(`
+				INSERT INTO "%s"."%s" (%s)
+				VALUES %s
+			`, repository.dbSchema, repository.tableName, repository.writeColumnList(), strings.Join(values, ", ")),
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return repository.audit(ctx, tx, model.AuditOperationInsert, casbinRules)
+}
+
+// insertAbsentCasbinRules inserts the casbin rules which no row holds yet
+func (repository *CasbinRuleRepository) insertAbsentCasbinRules(ctx context.Context, tx *sql.Tx, casbinRules []model.CasbinRule) error {
+	conditions := make([]string, 0, repository.fieldCount+2)
+	for _, column := range repository.writeColumns() {
+		conditions = append(conditions, fmt.Sprintf("stored.%[1]s IS NOT DISTINCT FROM absent.%[1]s", column))
+	}
+	if repository.temporal {
+		conditions = append(conditions, "stored.valid_to IS NULL")
+	}
+	maxRulesPerStatement := repository.maxRulesPerStatement()
+	for start := 0; start < len(casbinRules); start += maxRulesPerStatement {
+		end := start + maxRulesPerStatement
+		if end > len(casbinRules) {
+			end = len(casbinRules)
+		}
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*(repository.fieldCount+1))
+		for _, casbinRule := range casbinRules[start:end] {
+			casbinRuleValues, err := repository.values(casbinRule)
+			if err != nil {
+				return err
+			}
+			placeholders := make([]string, 0, len(casbinRuleValues))
+			for i := 1; i <= len(casbinRuleValues); i++ {
+				placeholders = append(placeholders, fmt.Sprintf("$%d::text", len(args)+i))
+			}
+			values = append(values, fmt.Sprintf("(%s)", strings.Join(placeholders, ", ")))
+			args = append(args, casbinRuleValues...)
+		}
+		rows, err := tx.QueryContext(
+			ctx,
+			fmt.Sprintf(`
+				INSERT INTO "%[1]s"."%[2]s" (%[3]s)
+				SELECT %[3]s FROM (VALUES %[4]s) AS absent (%[3]s)
+				WHERE NOT EXISTS (
+					SELECT 1 FROM "%[1]s"."%[2]s" AS stored
+					WHERE %[5]s
+				)
+				RETURNING %[6]s
+			`,
+				repository.dbSchema,
+				repository.tableName,
+				repository.writeColumnList(),
+				strings.Join(values, ", "),
+				strings.Join(conditions, " AND "),
+				repository.columnList(),
+			),
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		insertedCasbinRules, err := repository.loadPolicyFromRows(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if err = repository.audit(ctx, tx, model.AuditOperationInsert, insertedCasbinRules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteCasbinRule deletes casbinRule from db. Only the rows holding exactly
+// the fields of casbinRule are deleted.
 func (repository *CasbinRuleRepository) DeleteCasbinRule(casbinRule model.CasbinRule) error {
-	tx, err := repository.db.Begin()
+	return repository.DeleteCasbinRuleCtx(context.Background(), casbinRule)
+}
+
+// DeleteCasbinRuleCtx is DeleteCasbinRule with a context.Context
+func (repository *CasbinRuleRepository) DeleteCasbinRuleCtx(ctx context.Context, casbinRule model.CasbinRule) error {
+	return repository.DeleteCasbinRulesCtx(ctx, []model.CasbinRule{casbinRule})
+}
+
+// DeleteCasbinRules deletes casbinRules from db in a single transaction. Only
+// the rows holding exactly the fields of one of casbinRules are deleted.
+func (repository *CasbinRuleRepository) DeleteCasbinRules(casbinRules []model.CasbinRule) error {
+	return repository.DeleteCasbinRulesCtx(context.Background(), casbinRules)
+}
+
+// DeleteCasbinRulesCtx is DeleteCasbinRules with a context.Context
+func (repository *CasbinRuleRepository) DeleteCasbinRulesCtx(ctx context.Context, casbinRules []model.CasbinRule) error {
+	return repository.deleteCasbinRules(ctx, casbinRules, repository.casbinRuleExactCondition)
+}
+
+// DeleteFilteredCasbinRule deletes the casbin rules matching filter from db.
+// Empty fields of filter match any value.
+func (repository *CasbinRuleRepository) DeleteFilteredCasbinRule(filter model.CasbinRule) error {
+	return repository.DeleteFilteredCasbinRuleCtx(context.Background(), filter)
+}
+
+// DeleteFilteredCasbinRuleCtx is DeleteFilteredCasbinRule with a context.Context
+func (repository *CasbinRuleRepository) DeleteFilteredCasbinRuleCtx(ctx context.Context, filter model.CasbinRule) error {
+	return repository.deleteCasbinRules(ctx, []model.CasbinRule{filter}, repository.casbinRuleCondition)
+}
+
+func (repository *CasbinRuleRepository) deleteCasbinRules(
+	ctx context.Context,
+	casbinRules []model.CasbinRule,
+	casbinRuleCondition func(model.CasbinRule, []interface{}) (string, []interface{}, error),
+) error {
+	tx, err := repository.beginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	var queryBuilder strings.Builder
-	args := make([]interface{}, 0)
-	queryBuilder.WriteString(fmt.Sprintf(`
-			DELETE FROM "%s"."%s"
-			WHERE
-				p_type = $1
-	`, repository.dbSchema, repository.tableName))
+	maxRulesPerStatement := repository.maxRulesPerStatement()
+	for start := 0; start < len(casbinRules); start += maxRulesPerStatement {
+		end := start + maxRulesPerStatement
+		if end > len(casbinRules) {
+			end = len(casbinRules)
+		}
+		conditions := make([]string, 0, end-start)
+		args := make([]interface{}, 0)
+		for _, casbinRule := range casbinRules[start:end] {
+			var condition string
+			condition, args, err = casbinRuleCondition(casbinRule, args)
+			if err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			conditions = append(conditions, condition)
+		}
+		var scope string
+		scope, args = repository.scopeCondition(args)
+		rows, err := tx.QueryContext(
+			ctx,
+			fmt.Sprintf(`
+				%s
+				RETURNING %s
+			`, repository.removeStatement(fmt.Sprintf("( %s ) AND %s", strings.Join(conditions, " OR "), scope)), repository.columnList()),
+			args...,
+		)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		deletedCasbinRules, err := repository.loadPolicyFromRows(rows)
+		rows.Close()
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err = repository.audit(ctx, tx, model.AuditOperationDelete, deletedCasbinRules); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// casbinRuleCondition returns a where condition matching casbinRule, with its
+// values appended to args. Empty fields of casbinRule are left unconstrained.
+func (repository *CasbinRuleRepository) casbinRuleCondition(casbinRule model.CasbinRule, args []interface{}) (string, []interface{}, error) {
+	fields := casbinRule.Fields()
+	if len(fields) > repository.fieldCount {
+		return "", nil, fmt.Errorf(
+			"casbin rule has %d values but the table has %d value columns",
+			len(fields),
+			repository.fieldCount,
+		)
+	}
+	var conditionBuilder strings.Builder
 	args = append(args, casbinRule.PType)
+	conditionBuilder.WriteString(fmt.Sprintf("(p_type = $%d", len(args)))
 
-	if casbinRule.V0 != "" {
-		args = append(args, casbinRule.V0)
-		queryBuilder.WriteString(fmt.Sprintf("AND v0 = $%d ", len(args)))
+	for i, value := range fields {
+		if value != "" {
+			args = append(args, value)
+			conditionBuilder.WriteString(fmt.Sprintf(" AND v%d = $%d", i, len(args)))
+		}
 	}
-	if casbinRule.V1 != "" {
-		args = append(args, casbinRule.V1)
-		queryBuilder.WriteString(fmt.Sprintf("AND v1 = $%d ", len(args)))
+	conditionBuilder.WriteString(")")
+
+	return conditionBuilder.String(), args, nil
+}
+
+// casbinRuleExactCondition returns a where condition matching exactly
+// casbinRule, with its values appended to args. Empty fields of casbinRule only
+// match empty values, and absent fields only NULL columns.
+func (repository *CasbinRuleRepository) casbinRuleExactCondition(casbinRule model.CasbinRule, args []interface{}) (string, []interface{}, error) {
+	values, err := repository.values(casbinRule)
+	if err != nil {
+		return "", nil, err
 	}
-	if casbinRule.V2 != "" {
-		args = append(args, casbinRule.V2)
-		queryBuilder.WriteString(fmt.Sprintf("AND v2 = $%d ", len(args)))
+	conditions := make([]string, 0, len(values))
+	for i, column := range repository.writeColumns() {
+		if values[i] == nil {
+			conditions = append(conditions, fmt.Sprintf("%s IS NULL", column))
+			continue
+		}
+		args = append(args, values[i])
+		conditions = append(conditions, fmt.Sprintf("%s = $%d", column, len(args)))
 	}
-	if casbinRule.V3 != "" {
-		args = append(args, casbinRule.V3)
-		queryBuilder.WriteString(fmt.Sprintf("AND v3 = $%d ", len(args)))
+	return fmt.Sprintf("(%s)", strings.Join(conditions, " AND ")), args, nil
+}
+
+// UpdateCasbinRule replaces oldCasbinRule with newCasbinRule in db and returns
+// the number of rows updated
+func (repository *CasbinRuleRepository) UpdateCasbinRule(oldCasbinRule model.CasbinRule, newCasbinRule model.CasbinRule) (int64, error) {
+	return repository.UpdateCasbinRuleCtx(context.Background(), oldCasbinRule, newCasbinRule)
+}
+
+// UpdateCasbinRuleCtx is UpdateCasbinRule with a context.Context
+func (repository *CasbinRuleRepository) UpdateCasbinRuleCtx(ctx context.Context, oldCasbinRule model.CasbinRule, newCasbinRule model.CasbinRule) (int64, error) {
+	return repository.UpdateCasbinRulesCtx(ctx, []model.CasbinRule{oldCasbinRule}, []model.CasbinRule{newCasbinRule})
+}
+
+// UpdateCasbinRules replaces each of oldCasbinRules with the casbin rule at the
+// same position in newCasbinRules in a single transaction and returns the number
+// of rows updated
+func (repository *CasbinRuleRepository) UpdateCasbinRules(oldCasbinRules []model.CasbinRule, newCasbinRules []model.CasbinRule) (int64, error) {
+	return repository.UpdateCasbinRulesCtx(context.Background(), oldCasbinRules, newCasbinRules)
+}
+
+// UpdateCasbinRulesCtx is UpdateCasbinRules with a context.Context
+func (repository *CasbinRuleRepository) UpdateCasbinRulesCtx(ctx context.Context, oldCasbinRules []model.CasbinRule, newCasbinRules []model.CasbinRule) (int64, error) {
+	if len(oldCasbinRules) != len(newCasbinRules) {
+		return 0, fmt.Errorf("cannot update %d casbin rules with %d casbin rules", len(oldCasbinRules), len(newCasbinRules))
 	}
-	if casbinRule.V4 != "" {
-		args = append(args, casbinRule.V4)
-		queryBuilder.WriteString(fmt.Sprintf("AND v4 = $%d ", len(args)))
+	tx, err := repository.beginTx(ctx, nil)
+	if err != nil {
+		return 0, err
 	}
-	if casbinRule.V5 != "" {
-		args = append(args, casbinRule.V5)
-		queryBuilder.WriteString(fmt.Sprintf("AND v5 = $%d ", len(args)))
+	var updated int64
+	for i, oldCasbinRule := range oldCasbinRules {
+		if repository.temporal {
+			replaced, err := repository.replaceCasbinRule(ctx, tx, oldCasbinRule, newCasbinRules[i])
+			if err != nil {
+				_ = tx.Rollback()
+				return 0, err
+			}
+			updated += replaced
+			continue
+		}
+		args, err := repository.values(newCasbinRules[i])
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		assignments := make([]string, 0, len(args))
+		for j, column := range repository.writeColumns() {
+			assignments = append(assignments, fmt.Sprintf("%s = $%d", column, j+1))
+		}
+		var condition string
+		condition, args, err = repository.casbinRuleExactCondition(oldCasbinRule, args)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		rows, err := tx.QueryContext(
+			ctx,
+			fmt.Sprintf(`
+				UPDATE "%s"."%s"
+				SET %s
+				WHERE
+					%s
+				RETURNING %s
+			`, repository.dbSchema, repository.tableName, strings.Join(assignments, ", "), condition, repository.columnList()),
+			args...,
+		)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		updatedCasbinRules, err := repository.loadPolicyFromRows(rows)
+		rows.Close()
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		// The rows updated held exactly oldCasbinRule.
+		deletedCasbinRules := make([]model.CasbinRule, len(updatedCasbinRules))
+		for j := range deletedCasbinRules {
+			deletedCasbinRules[j] = oldCasbinRule
+		}
+		if err = repository.audit(ctx, tx, model.AuditOperationDelete, deletedCasbinRules); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		if err = repository.audit(ctx, tx, model.AuditOperationInsert, updatedCasbinRules); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		updated += int64(len(updatedCasbinRules))
 	}
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return updated, nil
+}
 
-	_, err = tx.Exec(
-		queryBuilder.String(),
+// replaceCasbinRule removes the rows holding exactly oldCasbinRule and inserts
+// newCasbinRule in place of each, returning their number. Unlike an update, it
+// keeps the rows of oldCasbinRule in temporal mode.
+func (repository *CasbinRuleRepository) replaceCasbinRule(
+	ctx context.Context,
+	tx *sql.Tx,
+	oldCasbinRule model.CasbinRule,
+	newCasbinRule model.CasbinRule,
+) (int64, error) {
+	if _, err := repository.values(newCasbinRule); err != nil {
+		return 0, err
+	}
+	condition, args, err := repository.casbinRuleExactCondition(oldCasbinRule, make([]interface{}, 0))
+	if err != nil {
+		return 0, err
+	}
+	scope, args := repository.scopeCondition(args)
+	rows, err := tx.QueryContext(
+		ctx,
+		fmt.Sprintf(`
+			%s
+			RETURNING %s
+		`, repository.removeStatement(fmt.Sprintf("%s AND %s", condition, scope)), repository.columnList()),
 		args...,
 	)
 	if err != nil {
+		return 0, err
+	}
+	removedCasbinRules, err := repository.loadPolicyFromRows(rows)
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+	if err = repository.audit(ctx, tx, model.AuditOperationDelete, removedCasbinRules); err != nil {
+		return 0, err
+	}
+	newCasbinRules := make([]model.CasbinRule, len(removedCasbinRules))
+	for i := range newCasbinRules {
+		newCasbinRules[i] = newCasbinRule
+	}
+	if err = repository.insertCasbinRules(ctx, tx, newCasbinRules); err != nil {
+		return 0, err
+	}
+	return int64(len(newCasbinRules)), nil
+}
+
+// UpdateFilteredCasbinRules replaces the casbin rules matching filter with
+// newCasbinRules in a single transaction and returns the casbin rules removed.
+// Empty fields of filter match any value.
+func (repository *CasbinRuleRepository) UpdateFilteredCasbinRules(filter model.CasbinRule, newCasbinRules []model.CasbinRule) ([]model.CasbinRule, error) {
+	return repository.UpdateFilteredCasbinRulesCtx(context.Background(), filter, newCasbinRules)
+}
+
+// UpdateFilteredCasbinRulesCtx is UpdateFilteredCasbinRules with a context.Context
+func (repository *CasbinRuleRepository) UpdateFilteredCasbinRulesCtx(ctx context.Context, filter model.CasbinRule, newCasbinRules []model.CasbinRule) ([]model.CasbinRule, error) {
+	condition, args, err := repository.casbinRuleCondition(filter, make([]interface{}, 0))
+	if err != nil {
+		return nil, err
+	}
+	scope, args := repository.scopeCondition(args)
+	tx, err := repository.beginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(
+		ctx,
+		fmt.Sprintf(`
+			%s
+			RETURNING %s
+		`, repository.removeStatement(fmt.Sprintf("%s AND %s", condition, scope)), repository.columnList()),
+		args...,
+	)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	oldCasbinRules, err := repository.loadPolicyFromRows(rows)
+	rows.Close()
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err = repository.audit(ctx, tx, model.AuditOperationDelete, oldCasbinRules); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err = repository.insertCasbinRules(ctx, tx, newCasbinRules); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return oldCasbinRules, nil
+}
+
+// ReplaceAllCasbinRules replaces the existing db with casbinRules
+func (repository *CasbinRuleRepository) ReplaceAllCasbinRules(casbinRules []model.CasbinRule) error {
+	return repository.ReplaceAllCasbinRulesCtx(context.Background(), casbinRules)
+}
+
+// ReplaceAllCasbinRulesCtx is ReplaceAllCasbinRules with a context.Context
+func (repository *CasbinRuleRepository) ReplaceAllCasbinRulesCtx(ctx context.Context, casbinRules []model.CasbinRule) error {
+	tx, err := repository.beginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = repository.clearCasbinRules(ctx, tx); err != nil {
 		_ = tx.Rollback()
 		return err
 	}
+
+	if err = repository.insertCasbinRules(ctx, tx, casbinRules); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
 	if err = tx.Commit(); err != nil {
 		_ = tx.Rollback()
 		return err
@@ -178,49 +904,185 @@ func (repository *CasbinRuleRepository) DeleteCasbinRule(casbinRule model.Casbin
 	return nil
 }
 
-// ReplaceAllCasbinRules replaces the existing db with casbinRules
-func (repository *CasbinRuleRepository) ReplaceAllCasbinRules(casbinRules []model.CasbinRule) error {
-	tx, err := repository.db.Begin()
+// clearCasbinRules removes the rows the repository applies to. The table is
+// truncated unless only some of its rows are removed, the rows removed are
+// audited or closed out.
+func (repository *CasbinRuleRepository) clearCasbinRules(ctx context.Context, tx *sql.Tx) error {
+	if !repository.tenantColumn && repository.auditTableName == "" && !repository.temporal {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+			TRUNCATE TABLE "%s"."%s"
+		`, repository.dbSchema, repository.tableName))
+		return err
+	}
+	scope, args := repository.scopeCondition(nil)
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+		%s
+		RETURNING %s
+	`, repository.removeStatement(scope), repository.columnList()), args...)
 	if err != nil {
 		return err
 	}
-	_, err = tx.Exec(fmt.Sprintf(`
-		TRUNCATE TABLE "%s"."%s"
-	`, repository.dbSchema, repository.tableName))
+	deletedCasbinRules, err := repository.loadPolicyFromRows(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	return repository.audit(ctx, tx, model.AuditOperationDelete, deletedCasbinRules)
+}
+
+// BulkInsertCasbinRules inserts casbin rules into db with the COPY protocol in
+// a single transaction, sending at most batchSize rules per COPY statement
+func (repository *CasbinRuleRepository) BulkInsertCasbinRules(casbinRules []model.CasbinRule, batchSize int) error {
+	return repository.BulkInsertCasbinRulesCtx(context.Background(), casbinRules, batchSize)
+}
+
+// BulkInsertCasbinRulesCtx is BulkInsertCasbinRules with a context.Context
+func (repository *CasbinRuleRepository) BulkInsertCasbinRulesCtx(ctx context.Context, casbinRules []model.CasbinRule, batchSize int) error {
+	if err := validateBatchSize(batchSize); err != nil {
+		return err
+	}
+	tx, err := repository.beginTx(ctx, nil)
 	if err != nil {
+		return err
+	}
+	if err = repository.copyCasbinRules(ctx, tx, casbinRules, batchSize); err != nil {
 		_ = tx.Rollback()
 		return err
 	}
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return nil
+}
 
-	values := make([]string, 0)
-	for _, casbinRule := range casbinRules {
-		value := fmt.Sprintf("(%s)", strings.Join([]string{
-			fmt.Sprintf("'%s'", casbinRule.PType),
-			fmt.Sprintf("'%s'", casbinRule.V0),
-			fmt.Sprintf("'%s'", casbinRule.V1),
-			fmt.Sprintf("'%s'", casbinRule.V2),
-			fmt.Sprintf("'%s'", casbinRule.V3),
-			fmt.Sprintf("'%s'", casbinRule.V4),
-			fmt.Sprintf("'%s'", casbinRule.V5),
-		}, ","))
-		values = append(values, value)
-	}
-
-	_, err = tx.Exec(
-		fmt.Sprintf(
-			`
-				INSERT INTO "%s".%s (p_type, v0, v1, v2, v3, v4, v5)
-				VALUES %s
-			`,
-			repository.dbSchema,
-			repository.tableName,
-			strings.Join(values, ",")),
-	)
+// CopyAllCasbinRules replaces the existing db with casbinRules, sending them
+// with the COPY protocol at most batchSize rules per COPY statement
+func (repository *CasbinRuleRepository) CopyAllCasbinRules(casbinRules []model.CasbinRule, batchSize int) error {
+	return repository.CopyAllCasbinRulesCtx(context.Background(), casbinRules, batchSize)
+}
+
+// CopyAllCasbinRulesCtx is CopyAllCasbinRules with a context.Context
+func (repository *CasbinRuleRepository) CopyAllCasbinRulesCtx(ctx context.Context, casbinRules []model.CasbinRule, batchSize int) error {
+	if err := validateBatchSize(batchSize); err != nil {
+		return err
+	}
+	tx, err := repository.beginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = repository.clearCasbinRules(ctx, tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err = repository.copyCasbinRules(ctx, tx, casbinRules, batchSize); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// validateBatchSize checks that batchSize is positive before a transaction is
+// started for copyCasbinRules
+func validateBatchSize(batchSize int) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("batch size must be positive but got %d", batchSize)
+	}
+	return nil
+}
+
+func (repository *CasbinRuleRepository) copyCasbinRules(ctx context.Context, tx *sql.Tx, casbinRules []model.CasbinRule, batchSize int) error {
+	for start := 0; start < len(casbinRules); start += batchSize {
+		end := start + batchSize
+		if end > len(casbinRules) {
+			end = len(casbinRules)
+		}
+		stmt, err := tx.PrepareContext(
+			ctx,
+			pq.CopyInSchema(repository.dbSchema, repository.tableName, repository.writeColumns()...),
+		)
+		if err != nil {
+			return err
+		}
+		for _, casbinRule := range casbinRules[start:end] {
+			values, err := repository.values(casbinRule)
+			if err != nil {
+				_ = stmt.Close()
+				return err
+			}
+			if _, err = stmt.ExecContext(ctx, values...); err != nil {
+				_ = stmt.Close()
+				return err
+			}
+		}
+		// Executing without arguments flushes the rows buffered for this COPY.
+		if _, err = stmt.ExecContext(ctx); err != nil {
+			_ = stmt.Close()
+			return err
+		}
+		if err = stmt.Close(); err != nil {
+			return err
+		}
+	}
+	return repository.audit(ctx, tx, model.AuditOperationInsert, casbinRules)
+}
+
+// SyncAllCasbinRules makes the casbin rules in db equal to casbinRules by
+// deleting and inserting only the rules which differ, in a single transaction.
+// Unlike ReplaceAllCasbinRules, it does not block readers of the table.
+func (repository *CasbinRuleRepository) SyncAllCasbinRules(casbinRules []model.CasbinRule) error {
+	return repository.SyncAllCasbinRulesCtx(context.Background(), casbinRules)
+}
+
+// SyncAllCasbinRulesCtx is SyncAllCasbinRules with a context.Context
+func (repository *CasbinRuleRepository) SyncAllCasbinRulesCtx(ctx context.Context, casbinRules []model.CasbinRule) error {
+	tx, err := repository.beginTx(ctx, nil)
 	if err != nil {
+		return err
+	}
+	if err = repository.syncCasbinRules(ctx, tx, casbinRules); err != nil {
 		_ = tx.Rollback()
 		return err
 	}
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return nil
+}
 
+// SyncFilteredCasbinRules makes the casbin rules in db matching any of filters
+// equal to casbinRules in a single transaction, leaving the other rows
+// untouched. filters are *model.Filter, *model.ConditionFilter or
+// model.PTypeFilter. A casbin rule outside filters is only inserted when no
+// row holds it yet.
+func (repository *CasbinRuleRepository) SyncFilteredCasbinRules(filters []interface{}, casbinRules []model.CasbinRule) error {
+	return repository.SyncFilteredCasbinRulesCtx(context.Background(), filters, casbinRules)
+}
+
+// SyncFilteredCasbinRulesCtx is SyncFilteredCasbinRules with a context.Context
+func (repository *CasbinRuleRepository) SyncFilteredCasbinRulesCtx(ctx context.Context, filters []interface{}, casbinRules []model.CasbinRule) error {
+	where, args, err := repository.filtersWhere(filters, make([]interface{}, 0))
+	if err != nil {
+		return err
+	}
+	tx, err := repository.beginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	missingCasbinRules, err := repository.syncCasbinRulesWhere(ctx, tx, where, args, casbinRules)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err = repository.insertAbsentCasbinRules(ctx, tx, missingCasbinRules); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
 	if err = tx.Commit(); err != nil {
 		_ = tx.Rollback()
 		return err
@@ -228,17 +1090,253 @@ func (repository *CasbinRuleRepository) ReplaceAllCasbinRules(casbinRules []mode
 	return nil
 }
 
-func filteredWhereValues(filter *model.Filter) ([]string, []string) {
-	p, g := []string{"%", "%", "%", "%", "%", "%"}, []string{"%", "%", "%", "%", "%", "%"}
-	for i, token := range filter.P {
-		if token != "" {
-			p[i] = token
+func (repository *CasbinRuleRepository) syncCasbinRules(ctx context.Context, tx *sql.Tx, casbinRules []model.CasbinRule) error {
+	missingCasbinRules, err := repository.syncCasbinRulesWhere(ctx, tx, "true", nil, casbinRules)
+	if err != nil {
+		return err
+	}
+	return repository.insertCasbinRules(ctx, tx, missingCasbinRules)
+}
+
+// syncCasbinRulesWhere deletes the rows matching the where clause which are not
+// in casbinRules or duplicate another row, and returns the casbin rules which
+// no such row holds
+func (repository *CasbinRuleRepository) syncCasbinRulesWhere(
+	ctx context.Context,
+	tx *sql.Tx,
+	where string,
+	args []interface{},
+	casbinRules []model.CasbinRule,
+) ([]model.CasbinRule, error) {
+	// SHARE ROW EXCLUSIVE keeps concurrent writers out while the difference is
+	// applied, but unlike TRUNCATE lets readers through.
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		LOCK TABLE "%s"."%s" IN SHARE ROW EXCLUSIVE MODE
+	`, repository.dbSchema, repository.tableName))
+	if err != nil {
+		return nil, err
+	}
+	scope, args := repository.scopeCondition(args)
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+		SELECT ctid, %s FROM "%s"."%s"
+		WHERE
+			( %s ) AND %s
+	`, repository.columnList(), repository.dbSchema, repository.tableName, where, scope), args...)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool, len(casbinRules))
+	for _, casbinRule := range casbinRules {
+		wanted[repository.key(casbinRule)] = true
+	}
+	stored := make(map[string]bool)
+	staleRowIDs := make([]string, 0)
+	for rows.Next() {
+		var rowID string
+		casbinRule, err := repository.scanCasbinRule(rows, &rowID)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		// Rows no longer wanted and duplicates of a stored row are removed.
+		key := repository.key(casbinRule)
+		if !wanted[key] || stored[key] {
+			staleRowIDs = append(staleRowIDs, rowID)
+			continue
+		}
+		stored[key] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for start := 0; start < len(staleRowIDs); start += maxRowIDsPerStatement {
+		end := start + maxRowIDsPerStatement
+		if end > len(staleRowIDs) {
+			end = len(staleRowIDs)
+		}
+		rows, err = tx.QueryContext(
+			ctx,
+			fmt.Sprintf(`
+				%s
+				RETURNING %s
+			`, repository.removeStatement("ctid = ANY($1::tid[])"), repository.columnList()),
+			pq.Array(staleRowIDs[start:end]),
+		)
+		if err != nil {
+			return nil, err
 		}
+		deletedCasbinRules, err := repository.loadPolicyFromRows(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err = repository.audit(ctx, tx, model.AuditOperationDelete, deletedCasbinRules); err != nil {
+			return nil, err
+		}
+	}
+
+	missingCasbinRules := make([]model.CasbinRule, 0)
+	for _, casbinRule := range casbinRules {
+		key := repository.key(casbinRule)
+		if !stored[key] {
+			missingCasbinRules = append(missingCasbinRules, casbinRule)
+			stored[key] = true
+		}
+	}
+	return missingCasbinRules, nil
+}
+
+// filterWhere returns the where clause matching the casbin rules filtered by
+// filter, with the tokens of filter appended to args
+func (repository *CasbinRuleRepository) filterWhere(filter *model.Filter, args []interface{}) (string, []interface{}, error) {
+	if len(filter.P) > repository.fieldCount || len(filter.G) > repository.fieldCount {
+		return "", nil, fmt.Errorf("filter has more values than the %d value columns of the table", repository.fieldCount)
+	}
+	var gConditions, pConditions []string
+	gConditions, args = filterConditions("g", filter.G, args)
+	pConditions, args = filterConditions("p", filter.P, args)
+	where := fmt.Sprintf(
+		"( %s ) OR ( %s )",
+		strings.Join(gConditions, " AND "),
+		strings.Join(pConditions, " AND "),
+	)
+	return where, args, nil
+}
+
+// filtersWhere returns the where clause matching the casbin rules filtered by
+// any of filters, which are *model.Filter, *model.ConditionFilter or
+// model.PTypeFilter, with the values of the filters appended to args
+func (repository *CasbinRuleRepository) filtersWhere(filters []interface{}, args []interface{}) (string, []interface{}, error) {
+	if len(filters) == 0 {
+		return "false", args, nil
 	}
-	for i, token := range filter.G {
+	wheres := make([]string, 0, len(filters))
+	for _, filter := range filters {
+		var where string
+		var err error
+		switch filterValue := filter.(type) {
+		case *model.Filter:
+			where, args, err = repository.filterWhere(filterValue, args)
+		case *model.ConditionFilter:
+			where, args, err = repository.conditionFilterWhere(filterValue, args)
+		case model.PTypeFilter:
+			where, args, err = repository.pTypeFilterWhere(filterValue, args)
+		default:
+			err = fmt.Errorf("invalid filter type %T", filter)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		wheres = append(wheres, fmt.Sprintf("( %s )", where))
+	}
+	return strings.Join(wheres, " OR "), args, nil
+}
+
+// filterConditions returns the where conditions matching the casbin rules of
+// section sec filtered by tokens, with the tokens appended to args. Empty
+// tokens are left unconstrained, so they also match absent values.
+func filterConditions(sec string, tokens []string, args []interface{}) ([]string, []interface{}) {
+	conditions := []string{fmt.Sprintf("p_type LIKE '%s%%'", sec)}
+	for i, token := range tokens {
 		if token != "" {
-			g[i] = token
+			args = append(args, token)
+			conditions = append(conditions, fmt.Sprintf("v%d LIKE $%d", i, len(args)))
 		}
 	}
-	return p, g
+	return conditions, args
 }
+
+// conditionFilterWhere returns the where clause matching the casbin rules
+// filtered by filter, with the values of its conditions appended to args
+func (repository *CasbinRuleRepository) conditionFilterWhere(filter *model.ConditionFilter, args []interface{}) (string, []interface{}, error) {
+	gConditions := []string{"p_type LIKE 'g%'"}
+	fieldConditions, args, err := repository.fieldConditions(filter.G, args)
+	if err != nil {
+		return "", nil, err
+	}
+	gConditions = append(gConditions, fieldConditions...)
+	pConditions := []string{"p_type LIKE 'p%'"}
+	fieldConditions, args, err = repository.fieldConditions(filter.P, args)
+	if err != nil {
+		return "", nil, err
+	}
+	pConditions = append(pConditions, fieldConditions...)
+	where := fmt.Sprintf(
+		"( %s ) OR ( %s )",
+		strings.Join(gConditions, " AND "),
+		strings.Join(pConditions, " AND "),
+	)
+	return where, args, nil
+}
+
+// pTypeFilterWhere returns the where clause matching the casbin rules filtered
+// by filter, with the values of its conditions appended to args
+func (repository *CasbinRuleRepository) pTypeFilterWhere(filter model.PTypeFilter, args []interface{}) (string, []interface{}, error) {
+	if len(filter) == 0 {
+		return "false", args, nil
+	}
+	// Sorting keeps the statement the same for the same filter.
+	pTypes := make([]string, 0, len(filter))
+	for pType := range filter {
+		pTypes = append(pTypes, pType)
+	}
+	sort.Strings(pTypes)
+	pTypeConditions := make([]string, 0, len(pTypes))
+	for _, pType := range pTypes {
+		args = append(args, pType)
+		conditions := []string{fmt.Sprintf("p_type = $%d", len(args))}
+		var fieldConditions []string
+		var err error
+		fieldConditions, args, err = repository.fieldConditions(filter[pType], args)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, fieldConditions...)
+		pTypeConditions = append(pTypeConditions, fmt.Sprintf("( %s )", strings.Join(conditions, " AND ")))
+	}
+	return strings.Join(pTypeConditions, " OR "), args, nil
+}
+
+// fieldConditions returns the where conditions matching the fields of a casbin
+// rule to conditions, the condition at index i applying to the value column vi,
+// with the values of conditions appended to args
+func (repository *CasbinRuleRepository) fieldConditions(conditions []model.Condition, args []interface{}) ([]string, []interface{}, error) {
+	if len(conditions) > repository.fieldCount {
+		return nil, nil, fmt.Errorf("filter has more conditions than the %d value columns of the table", repository.fieldCount)
+	}
+	fieldConditions := make([]string, 0, len(conditions))
+	for i, condition := range conditions {
+		if err := condition.Validate(); err != nil {
+			return nil, nil, err
+		}
+		column := fmt.Sprintf("v%d", i)
+		switch condition.Operator {
+		case model.OperatorAny:
+			continue
+		case model.OperatorEquals:
+			args = append(args, condition.Values[0])
+			fieldConditions = append(fieldConditions, fmt.Sprintf("%s = $%d", column, len(args)))
+		case model.OperatorNotEquals:
+			args = append(args, condition.Values[0])
+			fieldConditions = append(fieldConditions, fmt.Sprintf("%s IS DISTINCT FROM $%d", column, len(args)))
+		case model.OperatorPrefix:
+			args = append(args, likeEscaper.Replace(condition.Values[0])+"%")
+			fieldConditions = append(fieldConditions, fmt.Sprintf("%s LIKE $%d", column, len(args)))
+		case model.OperatorLike:
+			args = append(args, condition.Values[0])
+			fieldConditions = append(fieldConditions, fmt.Sprintf("%s LIKE $%d", column, len(args)))
+		case model.OperatorRegex:
+			args = append(args, condition.Values[0])
+			fieldConditions = append(fieldConditions, fmt.Sprintf("%s ~ $%d", column, len(args)))
+		case model.OperatorIn:
+			args = append(args, pq.Array(condition.Values))
+			fieldConditions = append(fieldConditions, fmt.Sprintf("%s = ANY($%d)", column, len(args)))
+		}
+	}
+	return fieldConditions, args, nil
+}
+
+// likeEscaper escapes the characters with a special meaning in a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
@@ -0,0 +1,187 @@
+package repository
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/cychiuae/casbin-pg-adapter/pkg/model"
+)
+
+func TestConditionFilterWhere(t *testing.T) {
+	repository := NewCasbinRuleRepository("public", "casbin_rule", nil)
+	filter := &model.ConditionFilter{
+		P: []model.Condition{
+			model.In("alice", "bob"),
+			{},
+			model.NotEquals("write"),
+			model.Prefix(`dom_1%\`),
+		},
+		G: []model.Condition{
+			model.Equals("alice"),
+			model.Regex("^admin"),
+			model.Like("dom%"),
+		},
+	}
+	where, args, err := repository.conditionFilterWhere(filter, make([]interface{}, 0))
+	if err != nil {
+		t.Fatalf("Cannot compile filter %v", err)
+	}
+	wantWhere := "( p_type LIKE 'g%' AND v0 = $1 AND v1 ~ $2 AND v2 LIKE $3 ) OR " +
+		"( p_type LIKE 'p%' AND v0 = ANY($4) AND v2 IS DISTINCT FROM $5 AND v3 LIKE $6 )"
+	if where != wantWhere {
+		t.Errorf("Expected %v but got %v", wantWhere, where)
+	}
+	wantArgs := []interface{}{
+		"alice",
+		"^admin",
+		"dom%",
+		pq.Array([]string{"alice", "bob"}),
+		"write",
+		`dom\_1\%\\%`,
+	}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("Expected %v but got %v", wantArgs, args)
+	}
+
+	invalidFilters := []*model.ConditionFilter{
+		{P: []model.Condition{{Operator: model.OperatorEquals}}},
+		{G: make([]model.Condition, 7)},
+	}
+	for _, filter := range invalidFilters {
+		if _, _, err = repository.conditionFilterWhere(filter, make([]interface{}, 0)); err == nil {
+			t.Errorf("Expected error for invalid filter %v", filter)
+		}
+	}
+}
+
+func TestPTypeFilterWhere(t *testing.T) {
+	repository := NewCasbinRuleRepository("public", "casbin_rule", nil)
+	filter := model.PTypeFilter{
+		"g2": {{}, model.Equals("resource_admin")},
+		"g":  {model.Equals("alice")},
+		"p2": nil,
+	}
+	where, args, err := repository.pTypeFilterWhere(filter, make([]interface{}, 0))
+	if err != nil {
+		t.Fatalf("Cannot compile filter %v", err)
+	}
+	wantWhere := "( p_type = $1 AND v0 = $2 ) OR ( p_type = $3 AND v1 = $4 ) OR ( p_type = $5 )"
+	if where != wantWhere {
+		t.Errorf("Expected %v but got %v", wantWhere, where)
+	}
+	wantArgs := []interface{}{"g", "alice", "g2", "resource_admin", "p2"}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("Expected %v but got %v", wantArgs, args)
+	}
+
+	if where, _, _ = repository.pTypeFilterWhere(model.PTypeFilter{}, make([]interface{}, 0)); where != "false" {
+		t.Errorf("Expected an empty filter to match nothing but got %v", where)
+	}
+}
+
+func TestFiltersWhere(t *testing.T) {
+	repository := NewCasbinRuleRepository("public", "casbin_rule", nil)
+	filters := []interface{}{
+		&model.Filter{P: []string{"alice"}},
+		model.PTypeFilter{"g2": {model.Equals("doc1")}},
+	}
+	where, args, err := repository.filtersWhere(filters, make([]interface{}, 0))
+	if err != nil {
+		t.Fatalf("Cannot compile filters %v", err)
+	}
+	wantWhere := "( ( p_type LIKE 'g%' ) OR ( p_type LIKE 'p%' AND v0 LIKE $1 ) ) OR ( ( p_type = $2 AND v0 = $3 ) )"
+	if where != wantWhere {
+		t.Errorf("Expected %v but got %v", wantWhere, where)
+	}
+	wantArgs := []interface{}{"alice", "g2", "doc1"}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("Expected %v but got %v", wantArgs, args)
+	}
+
+	if _, _, err = repository.filtersWhere([]interface{}{"alice"}, make([]interface{}, 0)); err == nil {
+		t.Errorf("Expected error for invalid filter type")
+	}
+}
+
+func TestForTenant(t *testing.T) {
+	repository := NewCasbinRuleRepository("public", "casbin_rule", nil)
+	if _, err := repository.ForTenant("tenant1"); err == nil {
+		t.Errorf("Expected error for a table without tenant column")
+	}
+	if scope, args := repository.scopeCondition(nil); scope != "true" || len(args) != 0 {
+		t.Errorf("Expected no scope but got %v %v", scope, args)
+	}
+
+	repository = NewCasbinRuleRepository("public", "casbin_rule", nil, WithTenantColumn(true))
+	tenantRepository, err := repository.ForTenant("tenant1")
+	if err != nil {
+		t.Fatalf("Cannot create tenant repository %v", err)
+	}
+	scope, args := tenantRepository.scopeCondition([]interface{}{"p"})
+	if scope != "tenant_id = $2" || !reflect.DeepEqual(args, []interface{}{"p", "tenant1"}) {
+		t.Errorf("Unexpected scope %v %v", scope, args)
+	}
+	if scope, args = repository.scopeCondition(nil); scope != "tenant_id = $1" || !reflect.DeepEqual(args, []interface{}{""}) {
+		t.Errorf("Unexpected scope %v %v", scope, args)
+	}
+	values, err := tenantRepository.values(model.NewCasbinRuleFromPTypeAndRule("p", []string{"alice"}))
+	if err != nil {
+		t.Fatalf("Cannot get values %v", err)
+	}
+	wantValues := []interface{}{"p", "alice", nil, nil, nil, nil, nil, "tenant1"}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Errorf("Expected %v but got %v", wantValues, values)
+	}
+}
+
+func TestTemporal(t *testing.T) {
+	repository := NewCasbinRuleRepository("public", "casbin_rule", nil)
+	if _, err := repository.LoadCasbinRulesAsOf(time.Now()); err == nil {
+		t.Errorf("Expected error for a table which is not temporal")
+	}
+	if statement := strings.TrimSpace(repository.removeStatement("v0 = $1")); !strings.HasPrefix(statement, `DELETE FROM "public"."casbin_rule"`) {
+		t.Errorf("Expected a delete but got %v", statement)
+	}
+
+	repository = NewCasbinRuleRepository("public", "casbin_rule", nil, WithTemporal(true))
+	if scope, args := repository.scopeCondition(nil); scope != "valid_to IS NULL" || len(args) != 0 {
+		t.Errorf("Unexpected scope %v %v", scope, args)
+	}
+	if statement := strings.TrimSpace(repository.removeStatement("v0 = $1")); !strings.HasPrefix(statement, `UPDATE "public"."casbin_rule"`) ||
+		!strings.Contains(statement, "SET valid_to = now()") {
+		t.Errorf("Expected a close out but got %v", statement)
+	}
+
+	repository = NewCasbinRuleRepository("public", "casbin_rule", nil, WithTemporal(true), WithTenantColumn(true))
+	tenantRepository, err := repository.ForTenant("tenant1")
+	if err != nil {
+		t.Fatalf("Cannot create tenant repository %v", err)
+	}
+	scope, args := tenantRepository.scopeCondition([]interface{}{"p"})
+	if scope != "tenant_id = $2 AND valid_to IS NULL" || !reflect.DeepEqual(args, []interface{}{"p", "tenant1"}) {
+		t.Errorf("Unexpected scope %v %v", scope, args)
+	}
+	tenant, args := tenantRepository.tenantCondition(nil)
+	if tenant != "tenant_id = $1" || !reflect.DeepEqual(args, []interface{}{"tenant1"}) {
+		t.Errorf("Unexpected tenant condition %v %v", tenant, args)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	// The batch size is checked before the db is reached, which a nil db would
+	// make panic.
+	repository := NewCasbinRuleRepository("public", "casbin_rule", nil)
+	casbinRules := []model.CasbinRule{model.NewCasbinRuleFromPTypeAndRule("p", []string{"alice", "data1", "read"})}
+	for _, batchSize := range []int{0, -1} {
+		if err := repository.BulkInsertCasbinRules(casbinRules, batchSize); err == nil {
+			t.Errorf("Expected error for batch size %v", batchSize)
+		}
+		if err := repository.CopyAllCasbinRules(casbinRules, batchSize); err == nil {
+			t.Errorf("Expected error for batch size %v", batchSize)
+		}
+	}
+}
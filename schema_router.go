@@ -0,0 +1,208 @@
+package casbinpgadapter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultSchemaPrefix is the prefix of the tenant schemas used by a
+	// SchemaRouter when none is given
+	DefaultSchemaPrefix = "tenant_"
+
+	// maxIdentifierLength is the number of bytes postgres keeps of an identifier
+	maxIdentifierLength = 63
+)
+
+// schemaNamePattern matches the tenant ids and schema prefixes a SchemaRouter
+// accepts, which need no quoting rules and keep their case in postgres
+var schemaNamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// SchemaRouter routes each tenant to an Adapter on a postgres schema of its
+// own, named after the tenant with a prefix. The schema and the casbin table are
+// created on first use.
+type SchemaRouter struct {
+	db           *sql.DB
+	schemaPrefix string
+	options      options
+	opts         []Option
+
+	// mutex guards adapters and setups, but is not held while a tenant is set up
+	mutex    sync.Mutex
+	adapters map[string]*Adapter
+	// setups are the tenants being set up, which concurrent callers wait for
+	setups map[string]*tenantSetup
+}
+
+// tenantSetup is the setup of the adapter of a tenant on first use
+type tenantSetup struct {
+	// done is closed once adapter and err are set
+	done    chan struct{}
+	adapter *Adapter
+	err     error
+}
+
+// NewSchemaRouter returns a new SchemaRouter whose tenant schemas are named
+// schemaPrefix followed by the tenant id. opts configure the adapter of each
+// tenant, but their schema. An empty schemaPrefix uses DefaultSchemaPrefix.
+func NewSchemaRouter(db *sql.DB, schemaPrefix string, opts ...Option) (*SchemaRouter, error) {
+	if schemaPrefix == "" {
+		schemaPrefix = DefaultSchemaPrefix
+	}
+	if !schemaNamePattern.MatchString(schemaPrefix) {
+		return nil, fmt.Errorf("schema prefix %q must only hold lowercase letters, digits and underscores", schemaPrefix)
+	}
+	o, err := newOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &SchemaRouter{
+		db:           db,
+		schemaPrefix: schemaPrefix,
+		options:      o,
+		opts:         opts,
+		adapters:     make(map[string]*Adapter),
+		setups:       make(map[string]*tenantSetup),
+	}, nil
+}
+
+// schema returns the schema of tenantID
+func (router *SchemaRouter) schema(tenantID string) (string, error) {
+	if !schemaNamePattern.MatchString(tenantID) {
+		return "", fmt.Errorf("tenant id %q must only hold lowercase letters, digits and underscores", tenantID)
+	}
+	schema := router.schemaPrefix + tenantID
+	if len(schema) > maxIdentifierLength {
+		return "", fmt.Errorf("schema %s of tenant %s is longer than %d bytes", schema, tenantID, maxIdentifierLength)
+	}
+	return schema, nil
+}
+
+// Adapter returns the adapter of tenantID, creating its schema and casbin table
+// on first use unless auto-migrate is disabled
+func (router *SchemaRouter) Adapter(tenantID string) (*Adapter, error) {
+	return router.AdapterCtx(context.Background(), tenantID)
+}
+
+// AdapterCtx is Adapter with a context.Context
+func (router *SchemaRouter) AdapterCtx(ctx context.Context, tenantID string) (*Adapter, error) {
+	schema, err := router.schema(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	router.mutex.Lock()
+	if adapter, ok := router.adapters[tenantID]; ok {
+		router.mutex.Unlock()
+		return adapter, nil
+	}
+	// The tenant is set up without holding the mutex, so that the other tenants
+	// are not held up by its DDL. The callers racing to set it up wait for the
+	// first one instead.
+	if setup, ok := router.setups[tenantID]; ok {
+		router.mutex.Unlock()
+		select {
+		case <-setup.done:
+			return setup.adapter, setup.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	setup := &tenantSetup{done: make(chan struct{})}
+	router.setups[tenantID] = setup
+	router.mutex.Unlock()
+
+	setup.adapter, setup.err = router.newAdapter(ctx, schema)
+	router.mutex.Lock()
+	// A failed setup is not kept, so that the next call retries it, nor is one
+	// whose tenant was dropped meanwhile.
+	if router.setups[tenantID] == setup {
+		delete(router.setups, tenantID)
+		if setup.err == nil {
+			router.adapters[tenantID] = setup.adapter
+		}
+	}
+	router.mutex.Unlock()
+	close(setup.done)
+	return setup.adapter, setup.err
+}
+
+// newAdapter returns a new adapter on schema, creating the schema unless
+// auto-migrate is disabled
+func (router *SchemaRouter) newAdapter(ctx context.Context, schema string) (*Adapter, error) {
+	if router.options.autoMigrate {
+		_, err := router.db.ExecContext(ctx, fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS "%s"`, schema))
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The schema of the tenant is set last, so that opts cannot override it.
+	opts := make([]Option, 0, len(router.opts)+1)
+	opts = append(opts, router.opts...)
+	opts = append(opts, WithDBSchema(schema))
+	return NewAdapterWithDBSchemaCtx(ctx, router.db, schema, router.options.tableName, opts...)
+}
+
+// Tenants returns the tenants whose schema holds the casbin table, in order
+func (router *SchemaRouter) Tenants() ([]string, error) {
+	return router.TenantsCtx(context.Background())
+}
+
+// TenantsCtx is Tenants with a context.Context
+func (router *SchemaRouter) TenantsCtx(ctx context.Context) ([]string, error) {
+	rows, err := router.db.QueryContext(
+		ctx,
+		`
+			SELECT table_schema FROM information_schema.tables
+			WHERE table_name = $1 AND left(table_schema, length($2::text)) = $2::text
+			ORDER BY table_schema
+		`,
+		router.options.tableName,
+		router.schemaPrefix,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tenants := make([]string, 0)
+	for rows.Next() {
+		var schema string
+		if err = rows.Scan(&schema); err != nil {
+			return nil, err
+		}
+		tenantID := strings.TrimPrefix(schema, router.schemaPrefix)
+		if schemaNamePattern.MatchString(tenantID) {
+			tenants = append(tenants, tenantID)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tenants, nil
+}
+
+// DropTenant drops the schema of tenantID along with everything it holds,
+// including its casbin table
+func (router *SchemaRouter) DropTenant(tenantID string) error {
+	return router.DropTenantCtx(context.Background(), tenantID)
+}
+
+// DropTenantCtx is DropTenant with a context.Context
+func (router *SchemaRouter) DropTenantCtx(ctx context.Context, tenantID string) error {
+	schema, err := router.schema(tenantID)
+	if err != nil {
+		return err
+	}
+	_, err = router.db.ExecContext(ctx, fmt.Sprintf(`DROP SCHEMA IF EXISTS "%s" CASCADE`, schema))
+	if err != nil {
+		return err
+	}
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	delete(router.adapters, tenantID)
+	delete(router.setups, tenantID)
+	return nil
+}
@@ -0,0 +1,140 @@
+package casbinpgadapter
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/util"
+)
+
+func TestSchemaRouterSchema(t *testing.T) {
+	router, err := NewSchemaRouter(nil, "")
+	if err != nil {
+		t.Fatalf("Cannot create schema router %v", err)
+	}
+	if schema, err := router.schema("acme_1"); err != nil || schema != "tenant_acme_1" {
+		t.Errorf("Expected schema tenant_acme_1 but got %v %v", schema, err)
+	}
+	for _, tenantID := range []string{"", "Acme", `acme"; DROP SCHEMA public; --`, strings.Repeat("a", 60)} {
+		if _, err = router.schema(tenantID); err == nil {
+			t.Errorf("Expected error for tenant id %q", tenantID)
+		}
+	}
+	if _, err = NewSchemaRouter(nil, "Tenant-"); err == nil {
+		t.Errorf("Expected error for invalid schema prefix")
+	}
+	if _, err = NewSchemaRouter(nil, "", WithTableName("")); err == nil {
+		t.Errorf("Expected error for invalid options")
+	}
+}
+
+func TestSchemaRouter(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+	router, err := NewSchemaRouter(db, "casbin_test_", WithTableName("casbin"))
+	if err != nil {
+		t.Fatalf("Cannot create schema router %v", err)
+		return
+	}
+	for _, tenantID := range []string{"acme", "globex", "initech"} {
+		if err = router.DropTenant(tenantID); err != nil {
+			t.Fatalf("Cannot drop tenant %v", err)
+			return
+		}
+	}
+
+	acme, err := router.Adapter("acme")
+	if err != nil {
+		t.Fatalf("Cannot create tenant adapter %v", err)
+		return
+	}
+	if cached, _ := router.Adapter("acme"); cached != acme {
+		t.Fatalf("Want the tenant adapter to be cached")
+		return
+	}
+	globex, err := router.Adapter("globex")
+	if err != nil {
+		t.Fatalf("Cannot create tenant adapter %v", err)
+		return
+	}
+
+	// The callers racing to use a tenant first share the adapter set up once.
+	adapters := make([]*Adapter, 8)
+	errs := make([]error, len(adapters))
+	var wg sync.WaitGroup
+	for i := range adapters {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			adapters[i], errs[i] = router.Adapter("initech")
+		}(i)
+	}
+	wg.Wait()
+	for i := range adapters {
+		if errs[i] != nil {
+			t.Fatalf("Cannot create tenant adapter %v", errs[i])
+			return
+		}
+		if adapters[i] != adapters[0] {
+			t.Fatalf("Want the tenant adapter to be set up once")
+			return
+		}
+	}
+	if err = router.DropTenant("initech"); err != nil {
+		t.Fatalf("Cannot drop tenant %v", err)
+		return
+	}
+
+	if err = acme.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatalf("Cannot add policy %v", err)
+		return
+	}
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", globex)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	if len(enforcer.GetPolicy()) != 0 {
+		t.Fatalf("Want no rules for globex but got %v", enforcer.GetPolicy())
+		return
+	}
+	enforcer, err = casbin.NewEnforcer("./example/model.conf", acme)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	want := [][]string{{"alice", "data1", "read"}}
+	if !util.Array2DEquals(enforcer.GetPolicy(), want) {
+		t.Fatalf("Want %v but got %v", want, enforcer.GetPolicy())
+		return
+	}
+
+	tenants, err := router.Tenants()
+	if err != nil {
+		t.Fatalf("Cannot list tenants %v", err)
+		return
+	}
+	if !util.ArrayEquals(tenants, []string{"acme", "globex"}) {
+		t.Fatalf("Want tenants acme and globex but got %v", tenants)
+		return
+	}
+	if err = router.DropTenant("acme"); err != nil {
+		t.Fatalf("Cannot drop tenant %v", err)
+		return
+	}
+	if tenants, err = router.Tenants(); err != nil || !util.ArrayEquals(tenants, []string{"globex"}) {
+		t.Fatalf("Want tenant globex but got %v %v", tenants, err)
+		return
+	}
+	if cached, _ := router.Adapter("acme"); cached == acme {
+		t.Fatalf("Want the adapter of a dropped tenant to be evicted")
+		return
+	}
+}
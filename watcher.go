@@ -0,0 +1,205 @@
+package casbinpgadapter
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin/v2/persist"
+	"github.com/lib/pq"
+)
+
+const (
+	// DefaultWatcherChannel is the channel used by a Watcher when none is given
+	DefaultWatcherChannel = "casbin_policy_update"
+
+	watcherMinReconnectInterval = 10 * time.Second
+	watcherMaxReconnectInterval = time.Minute
+	watcherPingInterval         = 90 * time.Second
+	// watcherMaxPayloadSize is the largest payload postgres accepts for NOTIFY
+	watcherMaxPayloadSize = 7999
+
+	watcherMethodUpdate                        = "Update"
+	watcherMethodUpdateForAddPolicies          = "UpdateForAddPolicies"
+	watcherMethodUpdateForRemovePolicies       = "UpdateForRemovePolicies"
+	watcherMethodUpdateForRemoveFilteredPolicy = "UpdateForRemoveFilteredPolicy"
+	watcherMethodUpdateForUpdatePolicies       = "UpdateForUpdatePolicies"
+)
+
+// Watcher is a casbin watcher which keeps the enforcers of several instances in
+// sync through postgres LISTEN/NOTIFY
+type Watcher struct {
+	db       *sql.DB
+	channel  string
+	id       string
+	listener *pq.Listener
+
+	mutex    sync.RWMutex
+	callback func(string)
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// watcherMessage is the payload sent on the watcher channel
+type watcherMessage struct {
+	ID          string     `json:"id"`
+	Method      string     `json:"method"`
+	Sec         string     `json:"sec,omitempty"`
+	PType       string     `json:"ptype,omitempty"`
+	Rules       [][]string `json:"rules,omitempty"`
+	OldRules    [][]string `json:"old_rules,omitempty"`
+	FieldIndex  int        `json:"field_index,omitempty"`
+	FieldValues []string   `json:"field_values,omitempty"`
+}
+
+var _ persist.Watcher = (*Watcher)(nil)
+
+// NewWatcher returns a new Watcher which notifies through db and listens on a
+// dedicated connection opened with dataSourceName. An empty channel uses
+// DefaultWatcherChannel.
+func NewWatcher(db *sql.DB, dataSourceName string, channel string) (*Watcher, error) {
+	if channel == "" {
+		channel = DefaultWatcherChannel
+	}
+	id, err := newWatcherID()
+	if err != nil {
+		return nil, err
+	}
+	watcher := &Watcher{
+		db:      db,
+		channel: channel,
+		id:      id,
+		done:    make(chan struct{}),
+	}
+	watcher.listener = pq.NewListener(
+		dataSourceName,
+		watcherMinReconnectInterval,
+		watcherMaxReconnectInterval,
+		watcher.handleListenerEvent,
+	)
+	if err := watcher.listener.Listen(channel); err != nil {
+		_ = watcher.listener.Close()
+		return nil, err
+	}
+
+	go watcher.listen()
+
+	return watcher, nil
+}
+
+func newWatcherID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// SetUpdateCallback sets the callback function that the watcher will call
+// when the policy in DB has been changed by other instances.
+func (watcher *Watcher) SetUpdateCallback(callback func(string)) error {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	watcher.callback = callback
+	return nil
+}
+
+// Update notifies the other instances that the policy in DB has been changed.
+func (watcher *Watcher) Update() error {
+	return watcher.publish(watcherMessage{Method: watcherMethodUpdate})
+}
+
+// Close stops and releases the watcher, the callback function will not be called any more.
+func (watcher *Watcher) Close() {
+	watcher.closeOnce.Do(func() {
+		close(watcher.done)
+		if err := watcher.listener.Close(); err != nil {
+			log.Printf("Cannot close watcher listener %v", err)
+		}
+	})
+}
+
+func (watcher *Watcher) publish(message watcherMessage) error {
+	message.ID = watcher.id
+	payload, err := encodeWatcherMessage(message)
+	if err != nil {
+		return err
+	}
+	_, err = watcher.db.Exec(`SELECT pg_notify($1, $2)`, watcher.channel, payload)
+	return err
+}
+
+// encodeWatcherMessage encodes message as a NOTIFY payload. A message too large
+// for NOTIFY is replaced by an Update message, asking peers for a full reload.
+func encodeWatcherMessage(message watcherMessage) (string, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	if len(payload) > watcherMaxPayloadSize {
+		payload, err = json.Marshal(watcherMessage{ID: message.ID, Method: watcherMethodUpdate})
+		if err != nil {
+			return "", err
+		}
+	}
+	return string(payload), nil
+}
+
+func (watcher *Watcher) listen() {
+	ticker := time.NewTicker(watcherPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-watcher.done:
+			return
+		case notification, ok := <-watcher.listener.Notify:
+			if !ok {
+				return
+			}
+			// A nil notification means the connection was re-established and
+			// notifications sent in between may have been lost.
+			if notification == nil {
+				watcher.runCallback("")
+				continue
+			}
+			var message watcherMessage
+			if err := json.Unmarshal([]byte(notification.Extra), &message); err != nil {
+				log.Printf("Cannot decode watcher message %v", err)
+				continue
+			}
+			if message.ID == watcher.id {
+				continue
+			}
+			watcher.runCallback(notification.Extra)
+		case <-ticker.C:
+			go func() {
+				if err := watcher.listener.Ping(); err != nil {
+					log.Printf("Cannot ping watcher listener %v", err)
+				}
+			}()
+		}
+	}
+}
+
+func (watcher *Watcher) runCallback(payload string) {
+	watcher.mutex.RLock()
+	callback := watcher.callback
+	watcher.mutex.RUnlock()
+	if callback != nil {
+		callback(payload)
+	}
+}
+
+func (watcher *Watcher) handleListenerEvent(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventDisconnected:
+		log.Printf("Watcher listener disconnected %v", err)
+	case pq.ListenerEventConnectionAttemptFailed:
+		log.Printf("Watcher listener cannot reconnect %v", err)
+	}
+}
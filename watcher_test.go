@@ -0,0 +1,89 @@
+package casbinpgadapter
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/util"
+)
+
+func TestWatcher(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatalf("Fail to open db %v", err)
+		return
+	}
+
+	enforcer, err := casbin.NewEnforcer("./example/model.conf", "./example/policy.csv")
+	if err != nil {
+		t.Fatal("Cannot create enforcer")
+		return
+	}
+	adapter, err := NewAdapter(db, "casbin")
+	if err != nil {
+		t.Fatalf("Cannot create adapter %v", err)
+		return
+	}
+	if err = adapter.SavePolicy(enforcer.GetModel()); err != nil {
+		t.Fatalf("Cannot initial policy %v", err)
+		return
+	}
+
+	watcher, err := NewWatcher(db, os.Getenv("DATABASE_URL"), "casbin_test")
+	if err != nil {
+		t.Fatalf("Cannot create watcher %v", err)
+		return
+	}
+	defer watcher.Close()
+	peerWatcher, err := NewWatcher(db, os.Getenv("DATABASE_URL"), "casbin_test")
+	if err != nil {
+		t.Fatalf("Cannot create watcher %v", err)
+		return
+	}
+	defer peerWatcher.Close()
+
+	enforcer, err = casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	if err = enforcer.SetWatcher(watcher); err != nil {
+		t.Fatalf("Cannot set watcher %v", err)
+		return
+	}
+	peerEnforcer, err := casbin.NewEnforcer("./example/model.conf", adapter)
+	if err != nil {
+		t.Fatalf("Cannot create enforcer %v", err)
+		return
+	}
+	updated := make(chan struct{}, 1)
+	if err = peerWatcher.SetUpdateCallback(func(string) {
+		if err := peerEnforcer.LoadPolicy(); err != nil {
+			t.Errorf("Cannot load policy %v", err)
+		}
+		updated <- struct{}{}
+	}); err != nil {
+		t.Fatalf("Cannot set update callback %v", err)
+		return
+	}
+
+	if _, err = enforcer.AddPolicy("alice", "data1", "write"); err != nil {
+		t.Fatalf("Cannot add policy %v", err)
+		return
+	}
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Peer watcher was not notified")
+		return
+	}
+	peerPolicy := peerEnforcer.GetPolicy()
+	want := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"alice", "data1", "write"}}
+	if !util.Array2DEquals(peerPolicy, want) {
+		t.Fatalf("Want %v but got %v", want, peerPolicy)
+		return
+	}
+}